@@ -1,77 +1,110 @@
 package dbyml
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	dockerStrSlice "github.com/docker/docker/api/types/strslice"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/moby/moby/api/types/strslice"
 	"github.com/moby/moby/pkg/stdcopy"
-	"github.com/moby/term"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // The container image used in buildkitd container
 const buildkitImageName = "moby/buildkit:v0.10.3"
 
+// The directory in builder under which the workspace of each build is created
+const builderWorkDir = "/work"
+
+// The filename of the image tarball exported in the workspace
+const exportTarName = "image.tar"
+
+// The timeout of cleaning up the builder after the build is finished or cancelled
+const cleanupTimeout = 2 * time.Minute
+
 // BuildkitInfo defines setting on build with buildkit.
 type BuildkitInfo struct {
-	Enabled  bool                   `yaml:"enabled"`
-	Output   map[string]interface{} `yaml:"output"`
-	Cache    map[string]interface{} `yaml:"cache"`
-	Platform []string               `yaml:"platform"`
-	Remove   bool                   `yaml:"remove"`
+	Enabled  bool       `yaml:"enabled"`
+	Output   OutputSpec `yaml:"output"`
+	Cache    CacheSpec  `yaml:"cache"`
+	Platform []string   `yaml:"platform"`
+	Remove   bool       `yaml:"remove"`
+
+	// Upper limit of the time until the builder is ready such as `2m`. No limit if empty.
+	StartupTimeout string `yaml:"startup_timeout"`
 }
 
 // NewBuildkitInfo makes BuildkitInfo object with default values.
 func NewBuildkitInfo() *BuildkitInfo {
 	build := new(BuildkitInfo)
 	build.Enabled = false
-	build.Output = map[string]interface{}{}
-	build.Cache = map[string]interface{}{}
 	build.Remove = true
+	build.StartupTimeout = "2m"
 	return build
 }
 
+// StartupTimeoutDuration returns the timeout of startup phase, or zero if the timeout is not set.
+func (buildkit *BuildkitInfo) StartupTimeoutDuration() (time.Duration, error) {
+	return parseTimeout("buildkit.startup_timeout", buildkit.StartupTimeout)
+}
+
+// Validate checks the output and cache settings.
+func (buildkit *BuildkitInfo) Validate() error {
+	if err := buildkit.Output.Validate(); err != nil {
+		return err
+	}
+	return buildkit.Cache.Validate()
+}
+
 // ParseOptions parses options related to buildkit and sets buildctl args.
-func (buildkit *BuildkitInfo) ParseOptions(imageInfo ImageInfo) []string {
+// The settings must be checked by Validate in advance.
+func (buildkit *BuildkitInfo) ParseOptions(imageInfo ImageInfo) ([]string, error) {
 	var opts []string
 	var cmd string
 
-	// Output
-	cmd = fmt.Sprintf("type=%s,name=%s,push=true", buildkit.Output["type"], buildkit.Output["name"])
-	if buildkit.Output["insecure"] == true {
-		cmd = fmt.Sprintf("%s,registry.insecure=true", cmd)
+	// Output. The output exported to host is passed as --output by Builder.SetExport.
+	if !buildkit.Output.IsExport() {
+		opts = append(opts, "--output", buildkit.Output.Option())
 	}
-	opts = append(opts, "--output", cmd)
 
-	// Cache
-	if len(buildkit.Cache) != 0 {
-		exportCache := buildkit.Cache["export"].(map[string]string)["type"]
-		if exportCache == "inline" {
-			cmd = "type=inline"
-		} else if exportCache == "registry" {
-			cmd = fmt.Sprintf("type=registry,ref=%s", buildkit.Cache["export"].(map[string]string)["value"])
+	// Cache. The local cache is passed by Builder.ImportCache and Builder.SetCacheExport.
+	if t := buildkit.Cache.Export.Type; t != "" && t != "local" {
+		opts = append(opts, "--export-cache", buildkit.Cache.Export.ExportOption())
+	}
+	for _, entry := range buildkit.Cache.Import {
+		if entry.Type != "" && entry.Type != "local" {
+			opts = append(opts, "--import-cache", entry.ImportOption())
 		}
-		opts = append(opts, "--export-cache", cmd)
+	}
 
-		importCache := buildkit.Cache["import"].(map[string]string)["type"]
-		if importCache == "registry" {
-			cmd = fmt.Sprintf(
-				"type=registry,ref=%s",
-				buildkit.Cache["import"].(map[string]string)["value"],
-			)
+	// Dockerfile in a subdirectory or with a name other than Dockerfile in the context
+	if imageInfo.IsDockerfileInContext() && imageInfo.Dockerfile != "Dockerfile" {
+		cmd = fmt.Sprintf("filename=%s", imageInfo.Dockerfile)
+		opts = append(opts, "--opt", cmd)
+	}
+
+	// Named build contexts. The local directories are passed as --local by Builder.CopyContexts.
+	for _, name := range sortedKeys(imageInfo.Contexts) {
+		value := imageInfo.Contexts[name]
+		if IsLocalContext(value) {
+			value = "local:" + name
 		}
-		opts = append(opts, "--import-cache", cmd)
+		opts = append(opts, "--opt", fmt.Sprintf("context:%s=%s", name, value))
 	}
 
 	// Platform
@@ -88,14 +121,24 @@ func (buildkit *BuildkitInfo) ParseOptions(imageInfo ImageInfo) []string {
 		}
 	}
 
-	if len(imageInfo.BuildArgs) != 0 {
-		for k, v := range imageInfo.BuildArgs {
-			cmd = fmt.Sprintf("build-arg:%s=%s", k, *v)
-			opts = append(opts, "--opt", cmd)
+	args, err := imageInfo.BuildArgValues()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range args {
+		if v == nil {
+			// The build arg without value is taken from the environment variable as docker build does.
+			value, ok := os.LookupEnv(k)
+			if !ok {
+				continue
+			}
+			v = &value
 		}
+		cmd = fmt.Sprintf("build-arg:%s=%s", k, *v)
+		opts = append(opts, "--opt", cmd)
 	}
 
-	return opts
+	return opts, nil
 }
 
 // Builder describes a container information on buildkit
@@ -105,19 +148,24 @@ type Builder struct {
 	ID             string                // The container ID
 	Config         *container.Config     // Container config
 	HostConfig     *container.HostConfig // Container host config
+	Workspace      string                // The directory in builder unique to each build
 	Context        string                // The build context in builder
 	DockerfilePath string                // The path to Dockerfile in builder
 	Cmd            []string              // The command executed in the builder
-	Client         *client.Client        // Docker client for connecting to builder
+	Client         DockerAPI             // Docker client for connecting to builder
+	BuildInfo      BuildInfo             // Build options applied to the files copied into builder
+	Progress       *Progress             // Progress output of buildctl
 }
 
 // NewBuilder creates a builder object with the default values.
+// Client is not set, which must be set to the client of the docker daemon before the builder is used.
 func NewBuilder() (builder *Builder) {
 	builder = new(Builder)
 	builder.Name = "dbyml-buildkit-builder"
 	builder.Image = BuildkitImage{buildkitImageName}
-	builder.Context = "/tmp"
-	builder.DockerfilePath = "/tmp"
+	builder.Workspace = builderWorkDir + "/" + newBuildID()
+	builder.Context = builder.Workspace + "/context"
+	builder.DockerfilePath = builder.Context
 	builder.Cmd = []string{
 		"buildctl",
 		"build",
@@ -138,7 +186,9 @@ func NewBuilder() (builder *Builder) {
 		NetworkMode: "host",
 		Privileged:  true,
 	}
-	builder.Client, _ = client.NewClientWithOpts(client.FromEnv)
+	builder.BuildInfo = *NewBuildInfo()
+	builder.Progress, _ = NewProgress(ProgressAuto)
+	builder.Progress.Builder = "buildkit"
 	return builder
 }
 
@@ -147,44 +197,54 @@ func (builder *Builder) AddCmd(cmd ...string) {
 	builder.Cmd = append(builder.Cmd, cmd...)
 }
 
+// SetLocal sets the directory in builder passed to buildctl as `--local name=dir`.
+// The existing directory with the same name is replaced.
+func (builder *Builder) SetLocal(name string, dir string) {
+	prefix := name + "="
+	for i := 0; i < len(builder.Cmd)-1; i++ {
+		if builder.Cmd[i] == "--local" && strings.HasPrefix(builder.Cmd[i+1], prefix) {
+			builder.Cmd[i+1] = prefix + dir
+			return
+		}
+	}
+	builder.AddCmd("--local", prefix+dir)
+}
+
 // Setup creates a builder container and copy setting toml into the builder.
-func (builder *Builder) Setup(config *RegistryInfo) error {
-	err := builder.Create()
-	if err != nil {
+// The container is removed if the setup fails so that the builder without the setting is not reused.
+func (builder *Builder) Setup(ctx context.Context, config *RegistryInfo) (err error) {
+	if err = builder.Create(ctx); err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			cleanCtx, cancel := cleanupContext()
+			defer cancel()
+			builder.Remove(cleanCtx)
+		}
+	}()
 
 	path, err := MakeBuildkitToml(config)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(path)
 
-	if err = builder.CopyFiles(path, "/etc"); err != nil {
-		return err
-	}
-
-	if err = os.Remove(path); err != nil {
-		return err
-	}
-
-	return nil
+	return builder.copyToBuilder(ctx, GetBuildkitContext(path), "/etc")
 }
 
 // Exists checks if a builder container exists.
-func (builder *Builder) Exists() bool {
-	json, err := builder.Inspect()
+func (builder *Builder) Exists(ctx context.Context) (bool, error) {
+	json, err := builder.Inspect(ctx)
 	if err != nil {
-		panic(err)
-	}
-	if json.ContainerJSONBase != nil {
-		return true
+		return false, err
 	}
-	return false
+	return json.ContainerJSONBase != nil, nil
 }
 
 // SetContainerID sets container ID of a builder.
-func (builder *Builder) SetContainerID() error {
-	json, err := builder.Inspect()
+func (builder *Builder) SetContainerID(ctx context.Context) error {
+	json, err := builder.Inspect(ctx)
 	if err != nil {
 		return err
 	}
@@ -193,10 +253,10 @@ func (builder *Builder) SetContainerID() error {
 }
 
 // Inspect gets a builder information.
-func (builder *Builder) Inspect() (types.ContainerJSON, error) {
+func (builder *Builder) Inspect(ctx context.Context) (types.ContainerJSON, error) {
 	var json types.ContainerJSON
 	ret, err := builder.Client.ContainerList(
-		context.Background(),
+		ctx,
 		types.ContainerListOptions{All: true},
 	)
 	if err != nil {
@@ -208,7 +268,7 @@ func (builder *Builder) Inspect() (types.ContainerJSON, error) {
 		for _, container := range ret {
 			for _, name := range container.Names {
 				if name == target {
-					return builder.Client.ContainerInspect(context.Background(), container.ID)
+					return builder.Client.ContainerInspect(ctx, container.ID)
 				}
 			}
 		}
@@ -217,9 +277,9 @@ func (builder *Builder) Inspect() (types.ContainerJSON, error) {
 }
 
 // Create creates a builder container.
-func (builder *Builder) Create() error {
+func (builder *Builder) Create(ctx context.Context) error {
 	body, err := builder.Client.ContainerCreate(
-		context.Background(),
+		ctx,
 		builder.Config,
 		builder.HostConfig,
 		&network.NetworkingConfig{},
@@ -234,88 +294,484 @@ func (builder *Builder) Create() error {
 }
 
 // Start starts a builder container.
-func (builder *Builder) Start() error {
+func (builder *Builder) Start(ctx context.Context) error {
 	return builder.Client.ContainerStart(
-		context.Background(),
+		ctx,
 		builder.ID,
 		types.ContainerStartOptions{},
 	)
 }
 
 // Stop stops a builder container.
-func (builder *Builder) Stop() error {
+func (builder *Builder) Stop(ctx context.Context) error {
 	timeout := time.Second * 60
-	return builder.Client.ContainerStop(context.Background(), builder.ID, &timeout)
+	return builder.Client.ContainerStop(ctx, builder.ID, &timeout)
 }
 
 // Remove removes a builder container.
-func (builder *Builder) Remove() error {
+func (builder *Builder) Remove(ctx context.Context) error {
 	return builder.Client.ContainerRemove(
-		context.Background(),
+		ctx,
 		builder.ID,
 		types.ContainerRemoveOptions{RemoveVolumes: true, RemoveLinks: false, Force: true},
 	)
 }
 
+// WaitReady waits until buildkitd in the builder accepts requests.
+func (builder *Builder) WaitReady(ctx context.Context) error {
+	for {
+		err := builder.exec(ctx, []string{"buildctl", "debug", "workers"}, false, ioutil.Discard, ioutil.Discard)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// CreateWorkspace creates the workspace directory for the build in builder.
+// The builder must be running.
+func (builder *Builder) CreateWorkspace(ctx context.Context) error {
+	return builder.Exec(ctx, []string{"mkdir", "-p", builder.Context, builder.ExportDir()})
+}
+
+// ExportDir returns the directory in the workspace where the build result is exported.
+func (builder *Builder) ExportDir() string {
+	return builder.Workspace + "/out"
+}
+
+// SetExport passes the output exported into the workspace to buildctl as `--output`.
+func (builder *Builder) SetExport(output *OutputSpec) {
+	var cmd string
+	if output.Type == "local" {
+		cmd = fmt.Sprintf("type=local,dest=%s", builder.ExportDir())
+	} else {
+		cmd = fmt.Sprintf("type=%s,dest=%s/%s", output.Type, builder.ExportDir(), exportTarName)
+		if output.Name != "" {
+			cmd = fmt.Sprintf("%s,name=%s", cmd, output.Name)
+		}
+	}
+	builder.AddCmd("--output", cmd)
+}
+
+// CopyExport copies the build result exported in the workspace out of builder.
+// The image of type docker is loaded into the docker daemon, and the other types are saved in dest on host.
+func (builder *Builder) CopyExport(ctx context.Context, output *OutputSpec) error {
+	reader, _, err := builder.Client.CopyFromContainer(ctx, builder.ID, builder.ExportDir())
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	prefix := path.Base(builder.ExportDir()) + "/"
+	dest := output.Dest
+	switch output.Type {
+	case "local":
+		return extractTar(reader, dest, prefix)
+	case "docker":
+		image, err := findTarEntry(reader, prefix+exportTarName)
+		if err != nil {
+			return err
+		}
+		res, err := builder.Client.ImageLoad(ctx, image, false)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		return builder.Progress.DisplayJSONMessages(res.Body)
+	default:
+		image, err := findTarEntry(reader, prefix+exportTarName)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return err
+		}
+		f, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(f, image)
+		return err
+	}
+}
+
+// CleanWorkspace removes the workspace directory and the files copied into it from builder.
+func (builder *Builder) CleanWorkspace(ctx context.Context) error {
+	return builder.Exec(ctx, []string{"rm", "-rf", builder.Workspace})
+}
+
 // CopyFiles copies directory in client to builder container.
 // If the directory contains some other directories, copy them recursively.
-func (builder *Builder) CopyFiles(path string, dst string) error {
+// The size of the files is checked against max_context_size in BuildInfo before copying,
+// and the files are compressed if compress is enabled in BuildInfo.
+func (builder *Builder) CopyFiles(ctx context.Context, path string, dst string) error {
+	if err := builder.BuildInfo.CheckContext(path); err != nil {
+		return err
+	}
+	buf, err := builder.BuildInfo.PrepareContext(path, GetBuildkitContext(path))
+	if err != nil {
+		return err
+	}
+	return builder.copyToBuilder(ctx, buf, dst)
+}
+
+// ImportCache copies each local cache directory on host into the workspace, and passes it to buildctl as `--import-cache`.
+// The import is skipped if the directory does not exist yet, such as on the first build.
+func (builder *Builder) ImportCache(ctx context.Context, cache *CacheSpec) error {
+	for i, entry := range cache.Import {
+		if entry.Type != "local" {
+			continue
+		}
+		src := entry.Src
+		if info, err := os.Stat(src); err != nil || !info.IsDir() {
+			fmt.Printf("Cache directory %v not found, skip importing cache.\n", src)
+			continue
+		}
+
+		entry.Src = fmt.Sprintf("%s/cache-import-%d", builder.Workspace, i)
+		if err := builder.Exec(ctx, []string{"mkdir", "-p", entry.Src}); err != nil {
+			return err
+		}
+		buf, err := builder.BuildInfo.PrepareContext(src, GetBuildkitContext(src))
+		if err != nil {
+			return err
+		}
+		if err := builder.copyToBuilder(ctx, buf, entry.Src); err != nil {
+			return err
+		}
+		builder.AddCmd("--import-cache", entry.ImportOption())
+	}
+	return nil
+}
+
+// SetCacheExport passes the directory in the workspace to buildctl as `--export-cache` for the local cache.
+func (builder *Builder) SetCacheExport(cache *CacheSpec) {
+	if cache.Export.Type != "local" {
+		return
+	}
+	entry := cache.Export
+	entry.Dest = builder.Workspace + "/cache-export"
+	builder.AddCmd("--export-cache", entry.ExportOption())
+}
+
+// CopyCacheExport copies the local cache exported in the workspace out of builder, and replaces dest on host with it.
+func (builder *Builder) CopyCacheExport(ctx context.Context, cache *CacheSpec) error {
+	if cache.Export.Type != "local" {
+		return nil
+	}
+	dir := builder.Workspace + "/cache-export"
+	reader, _, err := builder.Client.CopyFromContainer(ctx, builder.ID, dir)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	dest := filepath.Clean(cache.Export.Dest)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dest), filepath.Base(dest)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := extractTar(reader, tmp, path.Base(dir)+"/"); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// CopySecrets copies the value of each secret into the workspace, and passes it to buildctl as `--secret`.
+// The secrets are readable only by the owner in builder, and removed by RemoveSecrets after the build.
+func (builder *Builder) CopySecrets(ctx context.Context, secrets []SecretSpec) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	buf, err := secretArchive(secrets, "secrets")
+	if err != nil {
+		return err
+	}
+	if err := builder.copyToBuilder(ctx, buf, builder.Workspace); err != nil {
+		return err
+	}
+	for _, secret := range secrets {
+		builder.AddCmd("--secret", fmt.Sprintf("id=%s,src=%s", secret.ID, builder.SecretDir()+"/"+secret.ID))
+	}
+	return nil
+}
+
+// SecretDir returns the directory in the workspace where the secrets are copied.
+func (builder *Builder) SecretDir() string {
+	return builder.Workspace + "/secrets"
+}
+
+// RemoveSecrets removes the secrets and SSH keys copied into the workspace.
+func (builder *Builder) RemoveSecrets(ctx context.Context) error {
+	return builder.Exec(ctx, []string{"rm", "-rf", builder.SecretDir(), builder.SSHDir()})
+}
+
+// MountSSHAgents bind-mounts each SSH agent socket on host into builder, and passes it to buildctl as `--ssh`.
+// It must be called before the builder container is created, since the mounts are fixed on creation.
+// The socket is mounted from the machine where the daemon of dockerHost runs, so the daemon on another host is refused.
+func (builder *Builder) MountSSHAgents(specs []SSHSpec, dockerHost string) error {
+	for _, spec := range specs {
+		socket, err := spec.IsSocket()
+		if err != nil {
+			return err
+		}
+		if !socket {
+			continue
+		}
+		src, _ := spec.HostPath()
+		if !IsLocalDockerHost(dockerHost) {
+			return fmt.Errorf(
+				"ssh %v: the agent socket %v cannot be forwarded to the docker daemon %v on another host, set a private key instead",
+				spec.ID, src, dockerHost,
+			)
+		}
+		target := builderSSHDir + "/" + spec.ID + ".sock"
+		builder.HostConfig.Mounts = append(builder.HostConfig.Mounts, mount.Mount{
+			Type:   mount.TypeBind,
+			Source: src,
+			Target: target,
+		})
+		builder.AddCmd("--ssh", fmt.Sprintf("%s=%s", spec.ID, target))
+	}
+	return nil
+}
+
+// MountsChanged returns true if the existing builder container does not have the mounts to be set on creation,
+// such as the SSH agent socket of the new login session.
+func (builder *Builder) MountsChanged(ctx context.Context) (bool, error) {
+	json, err := builder.Inspect(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range builder.HostConfig.Mounts {
+		found := false
+		for _, mp := range json.Mounts {
+			if mp.Source == m.Source && mp.Destination == m.Target {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CopySSHKeys copies each private key forwarded by SSH into the workspace, and passes it to buildctl as `--ssh`.
+// The agent sockets are passed by MountSSHAgents instead. The keys are removed by RemoveSecrets after the build.
+func (builder *Builder) CopySSHKeys(ctx context.Context, specs []SSHSpec) error {
+	keys := []SecretSpec{}
+	for _, spec := range specs {
+		socket, err := spec.IsSocket()
+		if err != nil {
+			return err
+		}
+		if socket {
+			continue
+		}
+		src, _ := spec.HostPath()
+		keys = append(keys, SecretSpec{ID: spec.ID, Src: src})
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	buf, err := secretArchive(keys, "ssh")
+	if err != nil {
+		return err
+	}
+	if err := builder.copyToBuilder(ctx, buf, builder.Workspace); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		builder.AddCmd("--ssh", fmt.Sprintf("%s=%s", key.ID, builder.SSHDir()+"/"+key.ID))
+	}
+	return nil
+}
+
+// SSHDir returns the directory in the workspace where the SSH keys are copied.
+func (builder *Builder) SSHDir() string {
+	return builder.Workspace + "/ssh"
+}
+
+// CopyDockerfile copies the content of a Dockerfile outside the build context into
+// the directory in the workspace, and passes the directory to buildctl as `--local dockerfile=`.
+func (builder *Builder) CopyDockerfile(ctx context.Context, content []byte) error {
+	buf, err := AppendToContext(new(bytes.Buffer), "dockerfile/Dockerfile", content)
+	if err != nil {
+		return err
+	}
+	if err = builder.copyToBuilder(ctx, buf, builder.Workspace); err != nil {
+		return err
+	}
+	builder.DockerfilePath = builder.Workspace + "/dockerfile"
+	builder.SetLocal("dockerfile", builder.DockerfilePath)
+	return nil
+}
+
+// CopyContexts copies each named local build context into its own directory in the workspace,
+// and passes the directory to buildctl as `--local name=`.
+// The contexts other than local directories are passed to buildkit as is by ParseOptions.
+func (builder *Builder) CopyContexts(ctx context.Context, contexts map[string]string) error {
+	for _, name := range sortedKeys(contexts) {
+		if name == "context" || name == "dockerfile" {
+			return fmt.Errorf("the name %v of build context is reserved", name)
+		}
+		if !IsLocalContext(contexts[name]) {
+			continue
+		}
+		dir := builder.Workspace + "/contexts/" + name
+		if err := builder.Exec(ctx, []string{"mkdir", "-p", dir}); err != nil {
+			return err
+		}
+		if err := builder.CopyFiles(ctx, contexts[name], dir); err != nil {
+			return err
+		}
+		builder.SetLocal(name, dir)
+	}
+	return nil
+}
+
+// copyToBuilder extracts a tar archive into dst in builder container.
+func (builder *Builder) copyToBuilder(ctx context.Context, content io.Reader, dst string) error {
 	opts := types.CopyToContainerOptions{
 		AllowOverwriteDirWithFile: true,
 		CopyUIDGID:                false,
 	}
 	return builder.Client.CopyToContainer(
-		context.Background(),
+		ctx,
 		builder.ID,
 		dst,
-		GetBuildkitContext(path),
+		content,
 		opts,
 	)
 }
 
-// Build builds a image in a builder.
-func (builder *Builder) Build(debug bool) error {
-	if debug {
+// Build builds a image in a builder, and shows the progress of buildctl in the mode of Progress.
+func (builder *Builder) Build(ctx context.Context, debug bool) error {
+	cmd := append(append([]string{}, builder.Cmd...), "--progress", builder.Progress.BuildctlMode())
+	showCmd := func() {
 		fmt.Println("The following command will be run in buildkit container.")
 		re := regexp.MustCompile(`\s{1}-{2}`)
-		cmd := strings.Join(builder.Cmd, " ")
+		cmd := Redact(strings.Join(cmd, " "))
 		cmd = re.ReplaceAllString(cmd, "\n\t--")
 		fmt.Println(cmd)
 	}
-	return builder.Exec(builder.Cmd)
+	if debug {
+		showCmd()
+	} else {
+		builder.Progress.Log.Capture(showCmd)
+	}
+
+	if builder.Progress.BuildctlMode() == "tty" {
+		return builder.exec(ctx, cmd, true, os.Stdout, os.Stdout)
+	}
+
+	// The steps are rendered to stderr as buildctl does, and only if the build fails in quiet mode.
+	var display io.Writer = os.Stderr
+	var buf bytes.Buffer
+	switch builder.Progress.Mode {
+	case ProgressJSON:
+		display = nil
+	case ProgressQuiet:
+		display = &buf
+	}
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := builder.Progress.DisplayBuildctl(r, display)
+		// The rest of the output is drained, so that buildctl is not blocked if the display stops early.
+		io.Copy(ioutil.Discard, r)
+		done <- err
+	}()
+	err := builder.exec(ctx, cmd, false, w, w)
+	w.Close()
+	if displayErr := <-done; err == nil {
+		err = displayErr
+	}
+	if err != nil && builder.Progress.Mode == ProgressQuiet {
+		os.Stderr.Write(buf.Bytes())
+	}
+	return err
 }
 
 // Exec runs a command in buildkit container.
-func (builder *Builder) Exec(cmd []string) error {
+// Returns error if the command exits with non-zero status.
+func (builder *Builder) Exec(ctx context.Context, cmd []string) error {
+	return builder.exec(ctx, cmd, false, os.Stdout, os.Stderr)
+}
+
+// exec runs a command in buildkit container, and copies the output to stdout and stderr.
+// The output of the command with tty is copied to stdout as is.
+func (builder *Builder) exec(ctx context.Context, cmd []string, tty bool, stdout io.Writer, stderr io.Writer) error {
 	execConfig := types.ExecConfig{
 		Privileged:   true,
-		AttachStdin:  true,
+		AttachStdin:  tty,
 		AttachStdout: true,
 		AttachStderr: true,
-		Tty:          true,
+		Tty:          tty,
 		Detach:       false,
 		Cmd:          strslice.StrSlice(cmd),
 	}
 
 	// Create a new exec configuration to run an exec process.
-	res, err := builder.Client.ContainerExecCreate(context.Background(), builder.Name, execConfig)
+	res, err := builder.Client.ContainerExecCreate(ctx, builder.Name, execConfig)
 	if err != nil {
 		return err
 	}
 
 	// Run the exec process and attach it.
-	hijackRes, _ := builder.Client.ContainerExecAttach(
-		context.Background(),
+	hijackRes, err := builder.Client.ContainerExecAttach(
+		ctx,
 		res.ID,
-		types.ExecStartCheck{},
+		types.ExecStartCheck{Tty: tty},
 	)
-	defer func() error {
-		return hijackRes.Conn.Close()
+	if err != nil {
+		return err
+	}
+	defer hijackRes.Close()
+
+	// Reading the output is not stopped by ctx, so the connection is closed when ctx is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			hijackRes.Close()
+		case <-done:
+		}
 	}()
-	_, err = stdcopy.StdCopy(os.Stdout, os.Stderr, hijackRes.Reader)
+	if tty {
+		_, err = io.Copy(stdout, hijackRes.Reader)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, hijackRes.Reader)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		return err
 	}
+
+	inspect, err := builder.Client.ContainerExecInspect(ctx, res.ID)
+	if err != nil {
+		return err
+	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("%v exited with code %d", strings.Join(cmd, " "), inspect.ExitCode)
+	}
 	return nil
 }
 
@@ -325,30 +781,32 @@ type BuildkitImage struct {
 }
 
 // Exists checks if the image exists on host.
-func (buildkit *BuildkitImage) Exists() bool {
-	cli, _ := client.NewClientWithOpts(client.FromEnv)
-	imgs, err := cli.ImageList(context.Background(), types.ImageListOptions{})
+func (buildkit *BuildkitImage) Exists(ctx context.Context, cli DockerAPI) (bool, error) {
+	imgs, err := cli.ImageList(ctx, types.ImageListOptions{})
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 	for _, img := range imgs {
 		if contains(img.RepoTags, buildkit.Name) {
-			return true
+			return true, nil
 		}
 	}
-	return false
+	return false, nil
 }
 
-// Pull pulls a buildkit image from official dockerhub.
-func (buildkit *BuildkitImage) Pull() error {
-	cli, _ := client.NewClientWithOpts(client.FromEnv)
-	ret, err := cli.ImagePull(context.Background(), buildkit.Name, types.ImagePullOptions{})
+// Pull pulls a buildkit image from official dockerhub, and shows the progress in the mode of progress.
+func (buildkit *BuildkitImage) Pull(ctx context.Context, cli DockerAPI, progress *Progress) error {
+	ret, err := cli.ImagePull(ctx, buildkit.Name, types.ImagePullOptions{})
 	if err != nil {
 		return err
 	}
+	defer ret.Close()
+	return progress.DisplayJSONMessages(ret)
+}
 
-	termFd, isTerm := term.GetFdInfo(os.Stderr)
-	return jsonmessage.DisplayJSONMessagesStream(ret, os.Stderr, termFd, isTerm, nil)
+// cleanupContext returns the context used to clean up the builder, which is not cancelled with the build.
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
 }
 
 func contains(s []string, tag string) bool {
@@ -359,3 +817,12 @@ func contains(s []string, tag string) bool {
 	}
 	return false
 }
+
+// newBuildID returns a random ID used for the workspace of a build.
+func newBuildID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
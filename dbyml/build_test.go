@@ -1,31 +1,38 @@
 package dbyml
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// parseOptions returns the buildctl args of the settings, which must be valid.
+func parseOptions(t *testing.T, buildkit *BuildkitInfo, imageInfo ImageInfo) []string {
+	opts, err := buildkit.ParseOptions(imageInfo)
+	assert.Nil(t, err)
+	return opts
+}
+
 func TestParseOptions(t *testing.T) {
 	buildkitInfo := NewBuildkitInfo()
 
-	buildkitInfo.Output["type"] = "image"
-	buildkitInfo.Output["name"] = "myregistry.com:5000/test:latest"
-	buildkitInfo.Output["value"] = map[string]string{"type": "myregistry.com:5000/test:latest"}
-	buildkitInfo.Cache["export"] = map[string]string{"type": "inline"}
-	buildkitInfo.Cache["import"] = map[string]string{
-		"type":  "registry",
-		"value": "myregistry.com:5000/test:latest",
-	}
+	buildkitInfo.Output = OutputSpec{Type: "image", Name: "myregistry.com:5000/test:latest"}
+	buildkitInfo.Cache.Export = CacheEntry{Type: "inline"}
+	buildkitInfo.Cache.Import = CacheImports{{Type: "registry", Value: "myregistry.com:5000/test:latest"}}
 	buildkitInfo.Platform = []string{"linux/amd64", "linux/arm64"}
 
 	imageInfo := NewImageInfo()
 	arg := "value1"
-	imageInfo.BuildArgs = map[string]*string{"args1": &arg}
+	imageInfo.BuildArgs = map[string]*SecretValue{"args1": NewSecretValue(arg)}
 	imageInfo.Labels = map[string]string{"label1": "label_value"}
 
 	expected := []string{
@@ -42,70 +49,303 @@ func TestParseOptions(t *testing.T) {
 		"--opt",
 		"build-arg:args1=value1",
 	}
-	cmd := buildkitInfo.ParseOptions(*imageInfo)
+	cmd := parseOptions(t, buildkitInfo, *imageInfo)
 	assert.Equal(t, reflect.DeepEqual(cmd, expected), true)
 }
 
-func TestBuilderCreate(t *testing.T) {
+func TestParseOptionsContexts(t *testing.T) {
+	buildkitInfo := NewBuildkitInfo()
+	buildkitInfo.Output = OutputSpec{Type: "image", Name: "myregistry.com:5000/test:latest"}
+
+	imageInfo := NewImageInfo()
+	imageInfo.Contexts = map[string]string{
+		"shared": "../shared",
+		"base":   "docker-image://alpine:3.16",
+	}
+
+	expected := []string{
+		"--output",
+		"type=image,name=myregistry.com:5000/test:latest,push=true",
+		"--opt",
+		"context:base=docker-image://alpine:3.16",
+		"--opt",
+		"context:shared=local:shared",
+	}
+	assert.Equal(t, expected, parseOptions(t, buildkitInfo, *imageInfo))
+}
+
+func TestSetExport(t *testing.T) {
+	tests := []struct {
+		output   OutputSpec
+		expected string
+	}{
+		{OutputSpec{Type: "local", Dest: "out"}, "type=local,dest=%s/out"},
+		{OutputSpec{Type: "oci", Dest: "image.tar"}, "type=oci,dest=%s/out/image.tar"},
+		{OutputSpec{Type: "docker", Name: "test:latest"}, "type=docker,dest=%s/out/image.tar,name=test:latest"},
+	}
+	for _, tt := range tests {
+		buildkitInfo := NewBuildkitInfo()
+		buildkitInfo.Output = tt.output
+		assert.Nil(t, buildkitInfo.Validate())
+		assert.Equal(t, []string(nil), parseOptions(t, buildkitInfo, *NewImageInfo()))
+
+		builder := NewBuilder()
+		builder.SetExport(&buildkitInfo.Output)
+		n := len(builder.Cmd)
+		assert.Equal(t, []string{"--output", fmt.Sprintf(tt.expected, builder.Workspace)}, builder.Cmd[n-2:])
+	}
+}
+
+func TestSetLocal(t *testing.T) {
+	builder := NewBuilder()
+	builder.SetLocal("dockerfile", builder.Workspace+"/dockerfile")
+	builder.SetLocal("shared", builder.Workspace+"/contexts/shared")
+	expected := []string{
+		"buildctl",
+		"build",
+		"--frontend",
+		"dockerfile.v0",
+		"--local",
+		"context=" + builder.Workspace + "/context",
+		"--local",
+		"dockerfile=" + builder.Workspace + "/dockerfile",
+		"--local",
+		"shared=" + builder.Workspace + "/contexts/shared",
+	}
+	assert.Equal(t, expected, builder.Cmd)
+}
+
+func TestBuilderWorkspace(t *testing.T) {
+	builder := NewBuilder()
+	other := NewBuilder()
+	assert.Regexp(t, "^/work/[0-9a-f]{12}$", builder.Workspace)
+	assert.NotEqual(t, builder.Workspace, other.Workspace)
+	assert.Equal(t, builder.Workspace+"/context", builder.Context)
+	assert.Equal(t, builder.Context, builder.DockerfilePath)
+}
+
+// newDockerBuilder returns a builder connected to the docker daemon resolved without the settings in config.
+func newDockerBuilder(t *testing.T) *Builder {
+	t.Helper()
+	endpoint, err := ResolveDockerEndpoint("", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
 	builder := NewBuilder()
+	if builder.Client, err = NewDockerClient(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	return builder
+}
+
+func TestBuilderCreate(t *testing.T) {
+	ctx := context.Background()
+	builder := newDockerBuilder(t)
 	builder.Name = "gotest-builder"
 
-	builder.Create()
-	status, _ := builder.Inspect()
+	builder.Create(ctx)
+	status, _ := builder.Inspect(ctx)
 	assert.Equal(t, status.ContainerJSONBase.State.Status, "created")
-	builder.Remove()
+	builder.Remove(ctx)
 }
 
 func TestBuilderUseExisting(t *testing.T) {
-	builder := NewBuilder()
+	ctx := context.Background()
+	builder := newDockerBuilder(t)
 	builder.Name = "gotest-builder"
 
-	builder.Create()
-	assert.Equal(t, builder.Exists(), true)
-	builder.SetContainerID()
-	builder.Start()
+	builder.Create(ctx)
+	exists, err := builder.Exists(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, exists, true)
+	builder.SetContainerID(ctx)
+	builder.Start(ctx)
 	time.Sleep(time.Second * 2)
-	status, _ := builder.Inspect()
+	status, _ := builder.Inspect(ctx)
 	assert.Equal(t, status.ContainerJSONBase.State.Status, "running")
-	builder.Remove()
+	builder.Remove(ctx)
 }
 
 func TestBuilderStop(t *testing.T) {
-	builder := NewBuilder()
+	ctx := context.Background()
+	builder := newDockerBuilder(t)
 	builder.Name = "gotest-builder"
 
-	builder.Create()
-	builder.Start()
-	builder.Stop()
-	status, _ := builder.Inspect()
+	builder.Create(ctx)
+	builder.Start(ctx)
+	builder.Stop(ctx)
+	status, _ := builder.Inspect(ctx)
 	assert.Equal(t, status.ContainerJSONBase.State.Status, "exited")
-	builder.Remove()
+	builder.Remove(ctx)
 }
 
 // Build a image with buildkitd
 func TestBuilderBuild(t *testing.T) {
+	ctx := context.Background()
 	pwd, _ := os.Getwd()
 	root, _ := filepath.Abs("../")
 	os.Chdir(root)
 
-	builder := NewBuilder()
+	builder := newDockerBuilder(t)
 	builder.Name = "gotest-builder"
 	registry := NewRegistryInfo()
 
-	builder.Setup(registry)
-	builder.Start()
+	builder.Setup(ctx, registry)
+	builder.Start(ctx)
 	time.Sleep(time.Second * 2)
-	builder.CopyFiles("testdata/dockerfile_buildkit", "/tmp")
-	builder.Build(true)
-	builder.Remove()
+	builder.CreateWorkspace(ctx)
+	builder.CopyFiles(ctx, "testdata/dockerfile_buildkit", builder.Context)
+	builder.Build(ctx, true)
+	builder.CleanWorkspace(ctx)
+	builder.Remove(ctx)
 	os.Chdir(pwd)
 }
 
 func TestImagePull(t *testing.T) {
-	builder := NewBuilder()
-	builder.Image.Exists()
-	err := builder.Image.Pull()
+	ctx := context.Background()
+	builder := newDockerBuilder(t)
+	_, err := builder.Image.Exists(ctx, builder.Client)
+	assert.Nil(t, err)
+	err = builder.Image.Pull(ctx, builder.Client, builder.Progress)
 	if err != nil {
 		panic(err)
 	}
 }
+
+// newFakeBuilder returns a builder connected to the in-memory docker.
+func newFakeBuilder() (*Builder, *fakeDocker) {
+	fake := newFakeDocker()
+	builder := NewBuilder()
+	builder.Name = "gotest-builder"
+	builder.Client = fake
+	builder.Progress, _ = NewProgress(ProgressQuiet)
+	return builder, fake
+}
+
+func TestBuilderLifecycleFake(t *testing.T) {
+	ctx := context.Background()
+	pwd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(pwd)
+
+	builder, fake := newFakeBuilder()
+	exists, err := builder.Exists(ctx)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, builder.Setup(ctx, NewRegistryInfo()))
+	exists, _ = builder.Exists(ctx)
+	assert.True(t, exists)
+	assert.Contains(t, fake.Calls(), "CopyToContainer")
+	assert.NoFileExists(t, "buildkitd.toml")
+
+	// The existing builder is found by name.
+	other, _ := newFakeBuilder()
+	other.Client = fake
+	assert.Nil(t, other.SetContainerID(ctx))
+	assert.Equal(t, builder.ID, other.ID)
+
+	assert.Nil(t, builder.Start(ctx))
+	assert.Nil(t, builder.WaitReady(ctx))
+	status, _ := builder.Inspect(ctx)
+	assert.Equal(t, "running", status.State.Status)
+
+	assert.Nil(t, builder.Stop(ctx))
+	status, _ = builder.Inspect(ctx)
+	assert.Equal(t, "exited", status.State.Status)
+
+	assert.Nil(t, builder.Remove(ctx))
+	exists, _ = builder.Exists(ctx)
+	assert.False(t, exists)
+}
+
+func TestBuilderSetupFailureFake(t *testing.T) {
+	ctx := context.Background()
+	pwd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(pwd)
+
+	// The builder without the setting is removed not to be reused.
+	builder, fake := newFakeBuilder()
+	fake.errs["CopyToContainer"] = fmt.Errorf("copy failed")
+	assert.EqualError(t, builder.Setup(ctx, NewRegistryInfo()), "copy failed")
+	exists, _ := builder.Exists(ctx)
+	assert.False(t, exists)
+	assert.Contains(t, fake.Calls(), "ContainerRemove")
+}
+
+func TestBuilderExecFake(t *testing.T) {
+	ctx := context.Background()
+	builder, fake := newFakeBuilder()
+	assert.Nil(t, builder.Create(ctx))
+	assert.Nil(t, builder.Start(ctx))
+
+	var stdout, stderr bytes.Buffer
+	fake.execHandler = func(cmd []string) (string, string, int) {
+		return "out\n", "err\n", 2
+	}
+	err := builder.exec(ctx, []string{"false"}, false, &stdout, &stderr)
+	assert.EqualError(t, err, "false exited with code 2")
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+
+	// The builder not ready is waited until the timeout.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, builder.WaitReady(ctx))
+}
+
+func TestBuilderBuildDisplayErrorFake(t *testing.T) {
+	ctx := context.Background()
+	builder, fake := newFakeBuilder()
+	assert.Nil(t, builder.Create(ctx))
+	assert.Nil(t, builder.Start(ctx))
+
+	// The line longer than the limit of the display stops it, and the rest of the output must be drained.
+	fake.execHandler = func(cmd []string) (string, string, int) {
+		return "", strings.Repeat("x", 17*1024*1024) + "\n#1 DONE\n", 0
+	}
+	done := make(chan error, 1)
+	go func() { done <- builder.Build(ctx, false) }()
+	select {
+	case err := <-done:
+		assert.Equal(t, bufio.ErrTooLong, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("build did not return after the display stopped")
+	}
+}
+
+func TestBuildkitImagePullFake(t *testing.T) {
+	ctx := context.Background()
+	builder, fake := newFakeBuilder()
+	var buf bytes.Buffer
+	builder.Progress, _ = NewProgress(ProgressJSON)
+	builder.Progress.out = &buf
+
+	exists, err := builder.Image.Exists(ctx, fake)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, builder.Image.Pull(ctx, fake, builder.Progress))
+	exists, _ = builder.Image.Exists(ctx, fake)
+	assert.True(t, exists)
+
+	// The progress of pull is shown in the mode of progress, and the response is closed.
+	events := decodeEvents(t, &buf)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EventLog, events[0].Type)
+	assert.Equal(t, "Downloaded newer image for "+buildkitImageName, events[0].Message)
+	assert.True(t, fake.pullBody.closed)
+}
+
+func TestExistsErrorFake(t *testing.T) {
+	ctx := context.Background()
+	builder, fake := newFakeBuilder()
+
+	// The errors of docker are returned, not to stop the build without cleanup.
+	fake.errs["ContainerList"] = context.Canceled
+	fake.errs["ImageList"] = fmt.Errorf("daemon not responding")
+	_, err := builder.Exists(ctx)
+	assert.Equal(t, context.Canceled, err)
+	_, err = builder.Image.Exists(ctx, fake)
+	assert.EqualError(t, err, "daemon not responding")
+	assert.Equal(t, context.Canceled, startBuilder(ctx, builder, NewConfiguration()))
+}
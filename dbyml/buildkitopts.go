@@ -0,0 +1,226 @@
+package dbyml
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OutputSpec defines the output of the image built with buildkit.
+type OutputSpec struct {
+	// Type of output, one of image, registry, docker, oci, tar or local
+	Type string `yaml:"type"`
+
+	// Image name such as `myregistry.com:5000/project/image:tag`
+	Name string `yaml:"name"`
+
+	// Whether to push the image to insecure registry
+	Insecure bool `yaml:"insecure"`
+
+	// Path on host where the image is saved for oci, tar and local
+	Dest string `yaml:"dest"`
+}
+
+// IsExport returns true if the output type exports the built image to host instead of pushing it to a registry.
+// The type `docker` loads the image into the docker daemon, `oci` and `tar` save the image
+// as a tarball in dest, `local` exports the filesystem of the image into the directory dest.
+func (output *OutputSpec) IsExport() bool {
+	switch output.Type {
+	case "docker", "oci", "tar", "local":
+		return true
+	}
+	return false
+}
+
+// Validate checks the output has the fields required by the type.
+func (output *OutputSpec) Validate() error {
+	switch output.Type {
+	case "image", "registry", "docker":
+		if output.Name == "" {
+			return fmt.Errorf("buildkit output type %v requires name", output.Type)
+		}
+	case "oci", "tar", "local":
+		if output.Dest == "" {
+			return fmt.Errorf("buildkit output type %v requires dest", output.Type)
+		}
+	default:
+		return fmt.Errorf("unknown buildkit output type %q", output.Type)
+	}
+	return nil
+}
+
+// Option returns the value of buildctl --output pushing the image to a registry.
+func (output *OutputSpec) Option() string {
+	cmd := fmt.Sprintf("type=%s,name=%s,push=true", output.Type, output.Name)
+	if output.Insecure {
+		cmd = fmt.Sprintf("%s,registry.insecure=true", cmd)
+	}
+	return cmd
+}
+
+// CacheSpec defines the export and import of build cache.
+type CacheSpec struct {
+	Export CacheEntry   `yaml:"export"`
+	Import CacheImports `yaml:"import"`
+}
+
+// Validate checks the export and import settings of build cache.
+func (cache *CacheSpec) Validate() error {
+	if err := cache.Export.ValidateExport(); err != nil {
+		return err
+	}
+	for _, entry := range cache.Import {
+		if err := entry.ValidateImport(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CacheImports is the list of cache import sources. Buildkit tries the sources in order.
+type CacheImports []CacheEntry
+
+// UnmarshalYAML decodes either a list of cache import sources or a single source.
+func (imports *CacheImports) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []CacheEntry
+	if err := unmarshal(&list); err == nil {
+		*imports = list
+		return nil
+	}
+	var entry CacheEntry
+	if err := unmarshal(&entry); err != nil {
+		return err
+	}
+	*imports = CacheImports{entry}
+	return nil
+}
+
+// CacheEntry defines a backend of build cache. See https://github.com/moby/buildkit#cache for details.
+type CacheEntry struct {
+	// Type of cache backend, inline, registry or local. The cache is not used if empty.
+	Type string `yaml:"type"`
+
+	// Reference to the cache in registry such as `myregistry.com:5000/project/image:buildcache`
+	Value string `yaml:"value"`
+
+	// Directory on host where the cache is exported for local
+	Dest string `yaml:"dest"`
+
+	// Directory on host from which the cache is imported for local
+	Src string `yaml:"src"`
+
+	// Cache mode on export, min or max
+	Mode string `yaml:"mode"`
+
+	// Compression type of cache layers on export, gzip, estargz or zstd
+	Compression string `yaml:"compression"`
+
+	// Compression level of cache layers on export
+	CompressionLevel *int `yaml:"compression_level"`
+
+	// Whether to force compression of existing cache layers on export
+	ForceCompression bool `yaml:"force_compression"`
+
+	// Whether to use OCI media types in cache manifests on export
+	OCIMediaTypes *bool `yaml:"oci_mediatypes"`
+
+	// Whether to ignore the error on exporting cache
+	IgnoreError bool `yaml:"ignore_error"`
+}
+
+// ValidateExport checks the settings of the cache export.
+func (entry *CacheEntry) ValidateExport() error {
+	switch entry.Type {
+	case "":
+		return nil
+	case "inline":
+		if entry.Mode == "max" {
+			return fmt.Errorf("cache export type inline does not support mode max")
+		}
+	case "registry":
+		if entry.Value == "" {
+			return fmt.Errorf("cache export type registry requires value")
+		}
+	case "local":
+		if entry.Dest == "" {
+			return fmt.Errorf("cache export type local requires dest")
+		}
+	default:
+		return fmt.Errorf("unknown cache export type %q", entry.Type)
+	}
+
+	switch entry.Mode {
+	case "", "min", "max":
+	default:
+		return fmt.Errorf("unknown cache export mode %q", entry.Mode)
+	}
+	switch entry.Compression {
+	case "", "gzip", "estargz", "zstd":
+	default:
+		return fmt.Errorf("unknown cache compression %q", entry.Compression)
+	}
+	if entry.CompressionLevel != nil && entry.Compression == "" {
+		return fmt.Errorf("cache compression_level requires compression")
+	}
+	return nil
+}
+
+// ValidateImport checks the settings of the cache import.
+func (entry *CacheEntry) ValidateImport() error {
+	switch entry.Type {
+	case "":
+		return nil
+	case "registry":
+		if entry.Value == "" {
+			return fmt.Errorf("cache import type registry requires value")
+		}
+	case "local":
+		if entry.Src == "" {
+			return fmt.Errorf("cache import type local requires src")
+		}
+	default:
+		return fmt.Errorf("unknown cache import type %q", entry.Type)
+	}
+	if entry.Mode != "" || entry.Compression != "" || entry.CompressionLevel != nil ||
+		entry.ForceCompression || entry.OCIMediaTypes != nil || entry.IgnoreError {
+		return fmt.Errorf("cache import type %v supports only value or src", entry.Type)
+	}
+	return nil
+}
+
+// ExportOption returns the value of buildctl --export-cache.
+func (entry *CacheEntry) ExportOption() string {
+	attrs := []string{"type=" + entry.Type}
+	switch entry.Type {
+	case "registry":
+		attrs = append(attrs, "ref="+entry.Value)
+	case "local":
+		attrs = append(attrs, "dest="+entry.Dest)
+	}
+	if entry.Mode != "" {
+		attrs = append(attrs, "mode="+entry.Mode)
+	}
+	if entry.Compression != "" {
+		attrs = append(attrs, "compression="+entry.Compression)
+	}
+	if entry.CompressionLevel != nil {
+		attrs = append(attrs, fmt.Sprintf("compression-level=%d", *entry.CompressionLevel))
+	}
+	if entry.ForceCompression {
+		attrs = append(attrs, "force-compression=true")
+	}
+	if entry.OCIMediaTypes != nil {
+		attrs = append(attrs, fmt.Sprintf("oci-mediatypes=%t", *entry.OCIMediaTypes))
+	}
+	if entry.IgnoreError {
+		attrs = append(attrs, "ignore-error=true")
+	}
+	return strings.Join(attrs, ",")
+}
+
+// ImportOption returns the value of buildctl --import-cache.
+func (entry *CacheEntry) ImportOption() string {
+	if entry.Type == "local" {
+		return fmt.Sprintf("type=local,src=%s", entry.Src)
+	}
+	return fmt.Sprintf("type=%s,ref=%s", entry.Type, entry.Value)
+}
@@ -0,0 +1,225 @@
+package dbyml
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestOutputSpec(t *testing.T) {
+	tests := []struct {
+		output OutputSpec
+		valid  bool
+		export bool
+		option string
+	}{
+		{OutputSpec{Type: "image", Name: "reg/test:latest"}, true, false, "type=image,name=reg/test:latest,push=true"},
+		{OutputSpec{Type: "registry", Name: "reg/test:latest", Insecure: true}, true, false,
+			"type=registry,name=reg/test:latest,push=true,registry.insecure=true"},
+		{OutputSpec{Type: "image"}, false, false, ""},
+		{OutputSpec{Type: "docker", Name: "test:latest"}, true, true, ""},
+		{OutputSpec{Type: "docker"}, false, true, ""},
+		{OutputSpec{Type: "oci", Dest: "image.tar"}, true, true, ""},
+		{OutputSpec{Type: "tar"}, false, true, ""},
+		{OutputSpec{Type: "local", Dest: "rootfs"}, true, true, ""},
+		{OutputSpec{Type: "local"}, false, true, ""},
+		{OutputSpec{Type: ""}, false, false, ""},
+		{OutputSpec{Type: "unknown", Name: "test"}, false, false, ""},
+	}
+	for _, tt := range tests {
+		err := tt.output.Validate()
+		assert.Equal(t, tt.valid, err == nil, "%+v: %v", tt.output, err)
+		assert.Equal(t, tt.export, tt.output.IsExport(), "%+v", tt.output)
+		if tt.option != "" {
+			assert.Equal(t, tt.option, tt.output.Option())
+		}
+	}
+}
+
+func TestCacheExport(t *testing.T) {
+	level := 3
+	yes := true
+	no := false
+	tests := []struct {
+		entry  CacheEntry
+		valid  bool
+		option string
+	}{
+		{CacheEntry{}, true, ""},
+		{CacheEntry{Type: "inline"}, true, "type=inline"},
+		{CacheEntry{Type: "inline", Mode: "max"}, false, ""},
+		{CacheEntry{Type: "registry"}, false, ""},
+		{CacheEntry{Type: "registry", Value: "reg/test:cache"}, true, "type=registry,ref=reg/test:cache"},
+		{CacheEntry{Type: "registry", Value: "reg/test:cache", Mode: "max"}, true, "type=registry,ref=reg/test:cache,mode=max"},
+		{CacheEntry{Type: "registry", Value: "reg/test:cache", Mode: "all"}, false, ""},
+		{
+			CacheEntry{
+				Type: "registry", Value: "reg/test:cache", Mode: "max", Compression: "zstd",
+				CompressionLevel: &level, ForceCompression: true, OCIMediaTypes: &yes, IgnoreError: true,
+			},
+			true,
+			"type=registry,ref=reg/test:cache,mode=max,compression=zstd,compression-level=3," +
+				"force-compression=true,oci-mediatypes=true,ignore-error=true",
+		},
+		{CacheEntry{Type: "registry", Value: "reg/test:cache", OCIMediaTypes: &no}, true, "type=registry,ref=reg/test:cache,oci-mediatypes=false"},
+		{CacheEntry{Type: "registry", Value: "reg/test:cache", Compression: "lz4"}, false, ""},
+		{CacheEntry{Type: "registry", Value: "reg/test:cache", CompressionLevel: &level}, false, ""},
+		{CacheEntry{Type: "local"}, false, ""},
+		{CacheEntry{Type: "local", Dest: "/tmp/cache", Mode: "max"}, true, "type=local,dest=/tmp/cache,mode=max"},
+		{CacheEntry{Type: "s3"}, false, ""},
+	}
+	for _, tt := range tests {
+		err := tt.entry.ValidateExport()
+		assert.Equal(t, tt.valid, err == nil, "%+v: %v", tt.entry, err)
+		if tt.option != "" {
+			assert.Equal(t, tt.option, tt.entry.ExportOption())
+		}
+	}
+}
+
+func TestCacheImport(t *testing.T) {
+	yes := true
+	tests := []struct {
+		entry  CacheEntry
+		valid  bool
+		option string
+	}{
+		{CacheEntry{}, true, ""},
+		{CacheEntry{Type: "registry", Value: "reg/test:cache"}, true, "type=registry,ref=reg/test:cache"},
+		{CacheEntry{Type: "registry"}, false, ""},
+		{CacheEntry{Type: "registry", Value: "reg/test:cache", Mode: "max"}, false, ""},
+		{CacheEntry{Type: "registry", Value: "reg/test:cache", OCIMediaTypes: &yes}, false, ""},
+		{CacheEntry{Type: "inline"}, false, ""},
+		{CacheEntry{Type: "local"}, false, ""},
+		{CacheEntry{Type: "local", Src: "/tmp/cache"}, true, "type=local,src=/tmp/cache"},
+		{CacheEntry{Type: "local", Src: "/tmp/cache", Mode: "max"}, false, ""},
+	}
+	for _, tt := range tests {
+		err := tt.entry.ValidateImport()
+		assert.Equal(t, tt.valid, err == nil, "%+v: %v", tt.entry, err)
+		if tt.option != "" {
+			assert.Equal(t, tt.option, tt.entry.ImportOption())
+		}
+	}
+}
+
+// The nested maps in yaml are decoded into the typed settings.
+func TestBuildkitInfoYaml(t *testing.T) {
+	data := `
+buildkit:
+  enabled: true
+  output:
+    type: image
+    name: localhost:5550/test:latest
+    insecure: true
+  cache:
+    export:
+      type: registry
+      value: localhost:5550/test:cache
+      mode: max
+      oci_mediatypes: true
+    import:
+      type: registry
+      value: localhost:5550/test:cache
+`
+	config := NewConfiguration()
+	if err := yaml.Unmarshal([]byte(data), config); err != nil {
+		t.Fatal(err)
+	}
+	buildkit := config.BuildkitInfo
+	assert.Nil(t, buildkit.Validate())
+	expected := []string{
+		"--output",
+		"type=image,name=localhost:5550/test:latest,push=true,registry.insecure=true",
+		"--export-cache",
+		"type=registry,ref=localhost:5550/test:cache,mode=max,oci-mediatypes=true",
+		"--import-cache",
+		"type=registry,ref=localhost:5550/test:cache",
+	}
+	assert.Equal(t, expected, parseOptions(t, &buildkit, *NewImageInfo()))
+	assert.True(t, buildkit.Remove)
+}
+
+// The cache import accepts both a list of sources and a single source.
+func TestCacheImportsYaml(t *testing.T) {
+	data := `
+import:
+  - type: registry
+    value: reg/test:branch
+  - type: registry
+    value: reg/test:main
+  - type: local
+    src: /var/cache/test
+`
+	var cache CacheSpec
+	if err := yaml.Unmarshal([]byte(data), &cache); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, cache.Validate())
+	assert.Equal(t, 3, len(cache.Import))
+
+	buildkitInfo := NewBuildkitInfo()
+	buildkitInfo.Output = OutputSpec{Type: "image", Name: "reg/test:latest"}
+	buildkitInfo.Cache = cache
+	expected := []string{
+		"--output",
+		"type=image,name=reg/test:latest,push=true",
+		"--import-cache",
+		"type=registry,ref=reg/test:branch",
+		"--import-cache",
+		"type=registry,ref=reg/test:main",
+	}
+	assert.Equal(t, expected, parseOptions(t, buildkitInfo, *NewImageInfo()))
+
+	data = `
+import:
+  type: registry
+  value: reg/test:main
+`
+	cache = CacheSpec{}
+	if err := yaml.Unmarshal([]byte(data), &cache); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, CacheImports{{Type: "registry", Value: "reg/test:main"}}, cache.Import)
+
+	cache.Import = append(cache.Import, CacheEntry{Type: "registry"})
+	assert.Error(t, cache.Validate())
+}
+
+func TestLoadBuildkitConfig(t *testing.T) {
+	pwd, _ := os.Getwd()
+	root, _ := filepath.Abs("../")
+	os.Chdir(root)
+	defer os.Chdir(pwd)
+
+	config, err := LoadConfig("testdata/dockerfile_buildkit/dbyml.yml", "", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, config.BuildkitInfo.Validate())
+	cmd := parseOptions(t, &config.BuildkitInfo, config.ImageInfo)
+	assert.Contains(t, cmd, "type=inline")
+	assert.Contains(t, cmd, "type=registry,ref=localhost:5550/go-dbyml-sample:latest")
+}
+
+func TestLocalCache(t *testing.T) {
+	buildkitInfo := NewBuildkitInfo()
+	buildkitInfo.Output = OutputSpec{Type: "image", Name: "reg/test:latest"}
+	buildkitInfo.Cache.Export = CacheEntry{Type: "local", Dest: "cache", Mode: "max"}
+	buildkitInfo.Cache.Import = CacheImports{{Type: "local", Src: filepath.Join(t.TempDir(), "notexists")}}
+	assert.Nil(t, buildkitInfo.Validate())
+
+	// The local cache is not passed by ParseOptions.
+	expected := []string{"--output", "type=image,name=reg/test:latest,push=true"}
+	assert.Equal(t, expected, parseOptions(t, buildkitInfo, *NewImageInfo()))
+
+	builder := NewBuilder()
+	n := len(builder.Cmd)
+	// Importing cache is skipped since the directory does not exist.
+	assert.Nil(t, builder.ImportCache(context.Background(), &buildkitInfo.Cache))
+	builder.SetCacheExport(&buildkitInfo.Cache)
+	expected = []string{"--export-cache", "type=local,dest=" + builder.Workspace + "/cache-export,mode=max"}
+	assert.Equal(t, expected, builder.Cmd[n:])
+}
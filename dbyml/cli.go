@@ -14,13 +14,19 @@
 package dbyml
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"time"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/akamensky/argparse"
 )
 
+// ExitInterrupted is the exit status when the build is interrupted by SIGINT or SIGTERM.
+const ExitInterrupted = 130
+
 // CLIoptions defines cli options.
 type CLIoptions struct {
 	// Path to config file.
@@ -28,48 +34,57 @@ type CLIoptions struct {
 
 	// Whether to generate config file.
 	Init bool
+
+	// Progress output mode, which overrides build.progress in config.
+	Progress string
+
+	// Timeouts of the phases, which override build.timeout, push.timeout and buildkit.startup_timeout in config.
+	BuildTimeout   string
+	PushTimeout    string
+	StartupTimeout string
+
+	// Profile applied on the settings, or DBYML_PROFILE if empty.
+	Profile string
+
+	// Env files loaded before replacing the environment variables in the config file.
+	EnvFiles []string
+
+	// Whether to show the merged settings instead of build, and the file of each value.
+	ShowConfig bool
+	Origin     bool
 }
 
 // GetArgs gets cli options from user inputs.
 func GetArgs() (CLIoptions, bool) {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		return getConfigArgs(os.Args[1:])
+	}
+
 	desc := "Dbyml is a CLI tool to build a docker image with the arguments loaded from configs in yaml.\n\n"
 	desc += "Passing the config file where the arguments are listed to build the image from your dockerfile,\n"
 	desc += "push it to the docker registry.\n\n"
 	desc += "To make sample config file, run the following command.\n"
 	desc += "\n"
 	desc += "$ dbyml --init\n"
+	desc += "\n"
+	desc += "To show the settings merged from extends and include, run the following command.\n"
+	desc += "\n"
+	desc += "$ dbyml config show --origin\n"
 
 	parser := argparse.NewParser("dbyml", desc)
-	parser.HelpFunc = func(c *argparse.Command, msg interface{}) string {
-		var help string
-		help += fmt.Sprintln(c.GetDescription())
-		help += "Optional arguments:\n"
-		for _, arg := range c.GetArgs() {
-			if arg.GetOpts() != nil {
-				sopt := arg.GetSname()
-				var prefix string
-				var suffix string
-				if sopt != "" {
-					prefix = "-"
-					suffix = ","
-				} else {
-					prefix = ""
-					suffix = ""
-				}
-				sname := fmt.Sprintf("%v%s%v", prefix, sopt, suffix)
-				lname := fmt.Sprintf("--%-15s", arg.GetLname())
-				helpMsg := arg.GetOpts().Help
-				help += fmt.Sprintf("  %3s %s %s\n", sname, lname, helpMsg)
-			} else {
-				help += fmt.Sprintf("Sname: %s, Lname: %s\n", arg.GetSname(), arg.GetLname())
-			}
-		}
-		return help
-	}
+	parser.HelpFunc = usage
 
 	Config := parser.String("c", "config", &argparse.Options{Help: "Path to config file."})
 	Init := parser.Flag("", "init", &argparse.Options{Help: "Generate config."})
+	Profile := parser.String("p", "profile", &argparse.Options{Help: "Profile applied on the settings, default to DBYML_PROFILE."})
+	EnvFiles := parser.StringList("", "env-file", &argparse.Options{Help: "Env file loaded before the env_file in config. Can be repeated."})
 	Version := parser.Flag("v", "version", &argparse.Options{Help: "Show version."})
+	Progress := parser.Selector("", "progress", ProgressModes, &argparse.Options{
+		Help: "Progress output mode: " + strings.Join(ProgressModes, ", ") + ".",
+	})
+	BuildTimeout := parser.String("", "build-timeout", &argparse.Options{Help: "Timeout of build such as 30m."})
+	PushTimeout := parser.String("", "push-timeout", &argparse.Options{Help: "Timeout of push such as 10m."})
+	StartupTimeout := parser.String("", "startup-timeout", &argparse.Options{Help: "Timeout until the buildkit builder is ready."})
 
 	err := parser.Parse(os.Args)
 	if err != nil {
@@ -81,7 +96,67 @@ func GetArgs() (CLIoptions, bool) {
 		return CLIoptions{}, false
 	}
 
-	return CLIoptions{*Config, *Init}, true
+	return CLIoptions{
+		Config:         *Config,
+		Init:           *Init,
+		Progress:       *Progress,
+		Profile:        *Profile,
+		EnvFiles:       *EnvFiles,
+		BuildTimeout:   *BuildTimeout,
+		PushTimeout:    *PushTimeout,
+		StartupTimeout: *StartupTimeout,
+	}, true
+}
+
+// usage returns the help message of the command.
+func usage(c *argparse.Command, msg interface{}) string {
+	var help string
+	help += fmt.Sprintln(c.GetDescription())
+	help += "Optional arguments:\n"
+	for _, arg := range c.GetArgs() {
+		if arg.GetOpts() != nil {
+			sopt := arg.GetSname()
+			var prefix string
+			var suffix string
+			if sopt != "" {
+				prefix = "-"
+				suffix = ","
+			} else {
+				prefix = ""
+				suffix = ""
+			}
+			sname := fmt.Sprintf("%v%s%v", prefix, sopt, suffix)
+			lname := fmt.Sprintf("--%-15s", arg.GetLname())
+			helpMsg := arg.GetOpts().Help
+			help += fmt.Sprintf("  %3s %s %s\n", sname, lname, helpMsg)
+		} else {
+			help += fmt.Sprintf("Sname: %s, Lname: %s\n", arg.GetSname(), arg.GetLname())
+		}
+	}
+	return help
+}
+
+// getConfigArgs gets the options of `dbyml config` subcommands.
+func getConfigArgs(args []string) (CLIoptions, bool) {
+	parser := argparse.NewParser("dbyml config", "Inspect the configuration.")
+	parser.HelpFunc = usage
+	show := parser.NewCommand("show", "Show the settings merged from the config file and the files it extends and includes.")
+	Config := parser.String("c", "config", &argparse.Options{Help: "Path to config file."})
+	Profile := parser.String("p", "profile", &argparse.Options{Help: "Profile applied on the settings."})
+	EnvFiles := parser.StringList("", "env-file", &argparse.Options{Help: "Env file loaded before the env_file in config."})
+	Origin := show.Flag("", "origin", &argparse.Options{Help: "Show the file from which each value comes."})
+
+	if err := parser.Parse(args); err != nil {
+		fmt.Print(parser.Usage(err))
+		return CLIoptions{}, false
+	}
+	return CLIoptions{
+		Config:     *Config,
+		Profile:    *Profile,
+		EnvFiles:   *EnvFiles,
+		ShowConfig: show.Happened(),
+		Origin:     *Origin,
+	}, true
 }
 
 // Parse checks the input options, run actions according to the options.
@@ -91,15 +166,19 @@ func (options *CLIoptions) Parse() {
 		MakeTemplate(config)
 		return
 	}
+	action := func(path string) { ExecBuild(path, options) }
+	if options.ShowConfig {
+		action = func(path string) { ShowConfigFile(path, options.ProfileName(), options.EnvFiles, options.Origin) }
+	}
 	if options.Config != "" {
 		if exist := ConfigExists(options.Config); exist {
-			ExecBuild(options.Config)
+			action(options.Config)
 		} else {
 			fmt.Printf("%v not found. Check the file exists.\n", options.Config)
 		}
 	} else {
 		if exist := ConfigExists("dbyml.yml"); exist {
-			ExecBuild("dbyml.yml")
+			action("dbyml.yml")
 		} else {
 			msg := "Config file not found in the current directory.\nRun the following commands to generate config file."
 			fmt.Println(msg)
@@ -109,84 +188,307 @@ func (options *CLIoptions) Parse() {
 	}
 }
 
+// ProfileName returns the profile given by --profile or DBYML_PROFILE.
+func (options *CLIoptions) ProfileName() string {
+	if options.Profile != "" {
+		return options.Profile
+	}
+	return os.Getenv("DBYML_PROFILE")
+}
+
+// ShowConfigFile shows the settings merged from the config file and the files it extends and includes,
+// with the overlay of the profile if not empty. If origin is true, each value is followed by the file from which it comes.
+func ShowConfigFile(path string, profile string, envFiles []string, origin bool) {
+	file, err := ReadConfigFile(path, envFiles)
+	if err == nil {
+		err = file.ApplyProfile(profile)
+	}
+	if err == nil {
+		err = file.Show(os.Stdout, origin)
+	}
+	if err != nil {
+		fmt.Printf("Error has occurred: %v\n", err)
+		os.Exit(1)
+	}
+}
+
 // ExecBuild run the build sequence.
-func ExecBuild(path string) {
-	config := LoadConfig(path)
+// The options given on command line override the settings in config.
+func ExecBuild(path string, options *CLIoptions) {
+	config, err := LoadConfig(path, options.ProfileName(), options.EnvFiles)
+	if err != nil {
+		fmt.Printf("Error has occurred: %v\n", err)
+		os.Exit(1)
+	}
+	if options.Progress != "" {
+		config.BuildInfo.Progress = options.Progress
+	}
+	if options.BuildTimeout != "" {
+		config.BuildInfo.Timeout = options.BuildTimeout
+	}
+	if options.PushTimeout != "" {
+		config.PushInfo.Timeout = options.PushTimeout
+	}
+	if options.StartupTimeout != "" {
+		config.BuildkitInfo.StartupTimeout = options.StartupTimeout
+	}
+	timeouts, err := config.Timeouts()
+	if err != nil {
+		fmt.Printf("Error has occurred: %v\n", err)
+		os.Exit(1)
+	}
+	if err := config.ImageInfo.SetDockerClient(); err != nil {
+		fmt.Printf("Error has occurred: %v\n", err)
+		os.Exit(1)
+	}
+	progress, err := NewProgress(config.BuildInfo.Progress)
+	if err != nil {
+		fmt.Printf("Error has occurred: %v\n", err)
+		os.Exit(1)
+	}
+	progress.Summary = config.BuildInfo.Summary
+	if progress.SlowStep, err = config.BuildInfo.SlowStepThreshold(); err != nil {
+		fmt.Printf("Error has occurred: %v\n", err)
+		os.Exit(1)
+	}
+	restore := progress.Redirect()
+	var log *BuildLog
+	if config.BuildInfo.LogFile != "" {
+		if log, err = OpenBuildLog(config.BuildInfo.LogFile, &config.ImageInfo, config.BuildInfo.LogKeep); err != nil {
+			restore()
+			fmt.Printf("Error has occurred: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	progress.Log = log
+	closeLog := log.Tee()
+
 	config.ImageInfo.Registry = config.RegistryInfo
 	config.ImageInfo.BuildInfo = config.BuildInfo
+	config.ImageInfo.Progress = progress
 	if config.BuildInfo.Verbose {
 		config.ShowConfig()
+	} else {
+		log.Capture(config.ShowConfig)
 	}
 
+	// The build is cancelled on SIGINT or SIGTERM, and the builder and temporary files are cleaned up.
+	// The second signal stops dbyml immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	if config.BuildkitInfo.Enabled {
-		err := buildkit(path, config)
-		if err != nil {
-			fmt.Printf("Error has occurred: %v\n", err)
-			fmt.Println("\x1b[31mBuild Failed\x1b[0m")
-			os.Exit(1)
-		}
+		progress.Builder = "buildkit"
+		err = buildkit(ctx, path, config, timeouts)
 	} else {
-		err := dockerBuild(path, config)
-		if err != nil {
-			fmt.Printf("Error has occurred: %v\n", err)
-			fmt.Println("\x1b[31mBuild Failed\x1b[0m")
-			os.Exit(1)
-		}
+		err = dockerBuild(ctx, path, config, timeouts)
+	}
+	interrupted := ctx.Err() != nil
+	if interrupted {
+		err = fmt.Errorf("build interrupted")
+	}
+	if err != nil {
+		progress.Fail(err)
+	}
+
+	// The log file is closed before exit so that the output of failed build is saved.
+	closeLog()
+	if log != nil {
+		fmt.Fprintf(os.Stderr, "Build log saved to %v\n", log.Path)
+	}
+	restore()
+	if interrupted {
+		os.Exit(ExitInterrupted)
+	}
+	if err != nil {
+		os.Exit(1)
 	}
 }
 
-func buildkit(path string, config *Configuration) error {
-	fmt.Println()
-	PrintCenter("Build start", 30, "-")
-	fmt.Println()
+func buildkit(ctx context.Context, path string, config *Configuration, timeouts PhaseTimeouts) error {
+	progress := config.ImageInfo.Progress
+	progress.PhaseStart("build")
 
-	cmd := config.BuildkitInfo.ParseOptions(config.ImageInfo)
+	if err := config.BuildkitInfo.Validate(); err != nil {
+		return err
+	}
+	cmd, err := config.BuildkitInfo.ParseOptions(config.ImageInfo)
+	if err != nil {
+		return err
+	}
 	builder := NewBuilder()
+	builder.Client = config.ImageInfo.DockerClient
+	builder.BuildInfo = config.BuildInfo
+	builder.Progress = progress
 	builder.AddCmd(cmd...)
+	if config.BuildkitInfo.Output.IsExport() {
+		builder.SetExport(&config.BuildkitInfo.Output)
+	}
+	if err := builder.MountSSHAgents(config.ImageInfo.SSH, config.ImageInfo.DockerHost); err != nil {
+		return err
+	}
 
-	if !builder.Image.Exists() {
+	exists, err := builder.Image.Exists(ctx, builder.Client)
+	if err != nil {
+		return err
+	}
+	if !exists {
 		fmt.Printf("Image %s not found and will be pulled from docker hub.\n", buildkitImageName)
-		err := builder.Image.Pull()
+		err := builder.Image.Pull(ctx, builder.Client, progress)
 		if err != nil {
 			return err
 		}
 	}
 
-	if !builder.Exists() {
-		err := builder.Setup(&config.RegistryInfo)
-		if err != nil {
+	// The builder is stopped or removed even if the build fails or is cancelled.
+	defer func() {
+		cleanCtx, cancel := cleanupContext()
+		defer cancel()
+		if config.BuildkitInfo.Remove {
+			builder.Remove(cleanCtx)
+		} else {
+			builder.Stop(cleanCtx)
+		}
+	}()
+
+	err = runPhase(ctx, "startup", timeouts.Startup, func(ctx context.Context) error {
+		return startBuilder(ctx, builder, config)
+	})
+	if err == nil {
+		err = runPhase(ctx, "build", timeouts.Build, func(ctx context.Context) error {
+			if err := builder.CreateWorkspace(ctx); err != nil {
+				return err
+			}
+			return buildInWorkspace(ctx, builder, config)
+		})
+		cleanCtx, cancel := cleanupContext()
+		defer cancel()
+		if cleanErr := builder.CleanWorkspace(cleanCtx); err == nil {
+			err = cleanErr
+		}
+	}
+	progress.PhaseFinish("build", err)
+	progress.ShowSummary()
+	return err
+}
+
+// startBuilder creates or reuses the builder container, and waits until buildkitd in the builder is ready.
+func startBuilder(ctx context.Context, builder *Builder, config *Configuration) error {
+	exists, err := builder.Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := builder.Setup(ctx, &config.RegistryInfo); err != nil {
 			return err
 		}
 	} else {
-		err := builder.SetContainerID()
-		if err != nil {
+		if err := builder.SetContainerID(ctx); err != nil {
+			return err
+		}
+		if err := recreateOnMountsChanged(ctx, builder, &config.RegistryInfo); err != nil {
 			return err
 		}
 	}
+	if err := builder.Start(ctx); err != nil {
+		return err
+	}
+	return builder.WaitReady(ctx)
+}
 
-	builder.Start()
-	time.Sleep(time.Second * 3)
-	builder.CopyFiles(config.ImageInfo.Context, "/tmp")
-	err := builder.Build(config.BuildInfo.Verbose)
+// recreateOnMountsChanged recreates the existing builder if it does not have the mounts required by the build.
+func recreateOnMountsChanged(ctx context.Context, builder *Builder, registry *RegistryInfo) error {
+	changed, err := builder.MountsChanged(ctx)
+	if err != nil || !changed {
+		return err
+	}
+	fmt.Println("Recreating builder to mount the SSH agent socket.")
+	if err := builder.Remove(ctx); err != nil {
+		return err
+	}
+	return builder.Setup(ctx, registry)
+}
+
+// buildInWorkspace copies the build context and Dockerfile into the workspace of builder, and runs build.
+func buildInWorkspace(ctx context.Context, builder *Builder, config *Configuration) error {
+	contextDir := config.ImageInfo.Context
+	if IsRemoteContext(contextDir) {
+		fmt.Printf("Fetching remote build context %v\n", contextDir)
+		dir, cleanup, err := FetchRemoteContext(ctx, contextDir)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		contextDir = dir
+	}
+	if err := builder.CopyFiles(ctx, contextDir, builder.Context); err != nil {
+		return err
+	}
+	if err := builder.CopyContexts(ctx, config.ImageInfo.Contexts); err != nil {
+		return err
+	}
+	dockerfile, err := config.ImageInfo.ExternalDockerfile()
 	if err != nil {
 		return err
 	}
+	if dockerfile != nil {
+		if err := builder.CopyDockerfile(ctx, dockerfile); err != nil {
+			return err
+		}
+	}
+	if err := builder.ImportCache(ctx, &config.BuildkitInfo.Cache); err != nil {
+		return err
+	}
+	builder.SetCacheExport(&config.BuildkitInfo.Cache)
+	if err := builder.CopySecrets(ctx, config.ImageInfo.Secrets); err != nil {
+		return err
+	}
+	if err := builder.CopySSHKeys(ctx, config.ImageInfo.SSH); err != nil {
+		return err
+	}
+	err = builder.Build(ctx, config.BuildInfo.Verbose)
+	if len(config.ImageInfo.Secrets) != 0 || len(config.ImageInfo.SSH) != 0 {
+		// The secrets are removed even if the build is cancelled.
+		cleanCtx, cancel := cleanupContext()
+		defer cancel()
+		if rmErr := builder.RemoveSecrets(cleanCtx); err == nil {
+			err = rmErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := builder.CopyCacheExport(ctx, &config.BuildkitInfo.Cache); err != nil {
+		return err
+	}
 
-	if config.BuildkitInfo.Remove {
-		builder.Remove()
-	} else {
-		builder.Stop()
+	if config.BuildkitInfo.Output.IsExport() {
+		if err := builder.CopyExport(ctx, &config.BuildkitInfo.Output); err != nil {
+			return err
+		}
+		// The size of layer made by each step is shown in the summary.
+		if config.BuildkitInfo.Output.Type == "docker" && builder.Progress.Summary {
+			if history, err := builder.Client.ImageHistory(ctx, config.BuildkitInfo.Output.Name); err == nil {
+				builder.Progress.SetBuildkitLayerSizes(history)
+			}
+		}
+		if dest := config.BuildkitInfo.Output.Dest; dest != "" {
+			fmt.Printf("Build result exported to %v\n", dest)
+		}
 	}
 	return nil
 }
 
-func dockerBuild(path string, config *Configuration) error {
-	fmt.Println()
-	PrintCenter("Build start", 30, "-")
-	fmt.Println()
-	err := config.ImageInfo.Build()
-	PrintCenter("Build finish", 30, "-")
-	fmt.Println()
+func dockerBuild(ctx context.Context, path string, config *Configuration, timeouts PhaseTimeouts) error {
+	progress := config.ImageInfo.Progress
+	progress.PhaseStart("build")
+	err := runPhase(ctx, "build", timeouts.Build, config.ImageInfo.Build)
+	progress.PhaseFinish("build", err)
+	progress.ShowSummary()
 	if err != nil {
 		return err
 	}
@@ -194,14 +496,10 @@ func dockerBuild(path string, config *Configuration) error {
 	fmt.Printf("Image %v successfully built.\n", config.ImageInfo.ImageName)
 
 	if config.RegistryInfo.Enabled {
+		progress.PhaseStart("push")
+		err = runPhase(ctx, "push", timeouts.Push, config.ImageInfo.Push)
 		fmt.Println()
-		PrintCenter("Push start", 30, "-")
-		fmt.Println()
-		err = config.ImageInfo.Push()
-		fmt.Println()
-		PrintCenter("Push finish", 30, "-")
-
-		fmt.Println()
+		progress.PhaseFinish("push", err)
 		if err != nil {
 			return err
 		}
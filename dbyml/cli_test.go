@@ -2,6 +2,8 @@ package dbyml
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,14 +17,14 @@ func TestConfigNotFound(t *testing.T) {
 	root, _ := filepath.Abs("../")
 	os.Chdir(root)
 
-	options := CLIoptions{"", false}
+	options := CLIoptions{}
 	stdout := extractStdout(t, options.Parse)
 	expected := "Config file not found in the current directory.\n"
 	expected += "Run the following commands to generate config file.\n\n"
 	expected += "$ dbyml --init"
 	assert.Equal(t, expected, stdout)
 
-	options = CLIoptions{"notexists.yml", false}
+	options = CLIoptions{Config: "notexists.yml"}
 	options.Parse()
 	stdout = extractStdout(t, options.Parse)
 	expected = "notexists.yml not found. Check the file exists."
@@ -77,6 +79,75 @@ func TestCLIWithContext(t *testing.T) {
 	os.Chdir(pwd)
 }
 
+func TestDockerBuildFake(t *testing.T) {
+	pwd, _ := os.Getwd()
+	root, _ := filepath.Abs("../")
+	os.Chdir(root)
+	defer os.Chdir(pwd)
+
+	fake := newFakeDocker()
+	config := NewConfiguration()
+	config.ImageInfo.Basename = "gotest"
+	config.ImageInfo.Context = "testdata/dockerfile_standard"
+	config.ImageInfo.SetProperties()
+	config.ImageInfo.DockerClient = fake
+	config.ImageInfo.Progress, _ = NewProgress(ProgressQuiet)
+	config.RegistryInfo.Enabled = true
+	config.RegistryInfo.Host = "myregistry.com:5000"
+	config.ImageInfo.Registry = config.RegistryInfo
+
+	extractStdout(t, func() {
+		assert.Nil(t, dockerBuild(context.Background(), "dbyml.yml", config, PhaseTimeouts{}))
+	})
+	assert.Equal(t, []string{"ImageBuild", "ImageHistory", "ImageTag", "ImagePush"}, fake.Calls())
+	assert.Equal(t, 1, len(fake.contexts))
+	assert.Equal(t, []string{"myregistry.com:5000/gotest:latest"}, fake.pushed)
+
+	// The error on push is returned.
+	fake = newFakeDocker()
+	fake.errs["ImagePush"] = fmt.Errorf("denied")
+	config.ImageInfo.DockerClient = fake
+	extractStdout(t, func() {
+		assert.EqualError(t, dockerBuild(context.Background(), "dbyml.yml", config, PhaseTimeouts{}), "denied")
+	})
+	assert.Equal(t, []string(nil), fake.pushed)
+}
+
+func TestBuildkitFake(t *testing.T) {
+	ctx := context.Background()
+	pwd, _ := os.Getwd()
+	root, _ := filepath.Abs("../")
+	os.Chdir(root)
+	defer os.Chdir(pwd)
+
+	config := NewConfiguration()
+	config.ImageInfo.Context = "testdata/dockerfile_buildkit"
+	config.ImageInfo.SetProperties()
+	builder, fake := newFakeBuilder()
+	builds := [][]string{}
+	fake.execHandler = func(cmd []string) (string, string, int) {
+		if cmd[0] == "buildctl" && cmd[1] == "build" {
+			builds = append(builds, cmd)
+		}
+		return "", "", 0
+	}
+
+	extractStdout(t, func() {
+		assert.Nil(t, startBuilder(ctx, builder, config))
+		assert.Nil(t, builder.CreateWorkspace(ctx))
+		assert.Nil(t, buildInWorkspace(ctx, builder, config))
+	})
+	assert.Equal(t, 1, len(builds))
+	assert.Contains(t, builds[0], "context="+builder.Context)
+	assert.Contains(t, fake.containers[builder.ID].Files, builder.Context+"/Dockerfile")
+
+	// The workspace is removed after the build.
+	assert.Nil(t, builder.CleanWorkspace(ctx))
+	for name := range fake.containers[builder.ID].Files {
+		assert.NotContains(t, name, builder.Workspace)
+	}
+}
+
 func extractStdout(t *testing.T, fnc func()) string {
 	t.Helper()
 
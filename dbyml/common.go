@@ -2,7 +2,9 @@ package dbyml
 
 import (
 	"fmt"
+	"os"
 	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -21,7 +23,14 @@ func PrintCenter(s string, w int, padding string) {
 func showMapElement(name string, iter *reflect.MapIter) {
 	cnt := 0
 	for iter.Next() {
-		if iter.Value().Kind() == reflect.Ptr {
+		if _, ok := iter.Value().Interface().(fmt.Stringer); ok {
+			// The value such as SecretValue shows only what is safe to print.
+			if cnt == 0 {
+				fmt.Printf("%-30v: %v: %v\n", name, iter.Key(), iter.Value().Interface())
+			} else {
+				fmt.Printf("%-30v: %v: %v\n", "", iter.Key(), iter.Value().Interface())
+			}
+		} else if iter.Value().Kind() == reflect.Ptr {
 			if cnt == 0 {
 				fmt.Printf("%-30v: %v: %v\n", name, iter.Key(), iter.Value().Elem())
 			} else {
@@ -37,3 +46,19 @@ func showMapElement(name string, iter *reflect.MapIter) {
 		cnt++
 	}
 }
+
+// fileExists returns true if a regular file exists in the path.
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// sortedKeys returns the keys of a map in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
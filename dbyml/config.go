@@ -1,12 +1,12 @@
 package dbyml
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"regexp"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	units "github.com/docker/go-units"
 )
 
 // Configuration defines the hierarchy of the settings in config file.
@@ -15,6 +15,10 @@ type Configuration struct {
 	BuildInfo    BuildInfo    `yaml:"build"`
 	RegistryInfo RegistryInfo `yaml:"registry"`
 	BuildkitInfo BuildkitInfo `yaml:"buildkit"`
+	PushInfo     PushInfo     `yaml:"push"`
+
+	// The profile applied on the settings
+	Profile string `yaml:"-"`
 }
 
 // NewConfiguration makes Configuration struct with default values.
@@ -24,12 +28,16 @@ func NewConfiguration() *Configuration {
 	config.BuildInfo = *NewBuildInfo()
 	config.RegistryInfo = *NewRegistryInfo()
 	config.BuildkitInfo = *NewBuildkitInfo()
+	config.PushInfo = PushInfo{}
 	return config
 }
 
 // ShowConfig shows the current Configuration to stdout.
 func (config *Configuration) ShowConfig() {
 	PrintCenter("Build info", 30, "-")
+	if config.Profile != "" {
+		fmt.Printf("%-30v: %v\n", "Profile", config.Profile)
+	}
 	config.ImageInfo.ShowProperties()
 	fmt.Println()
 	PrintCenter("Registry info", 30, "-")
@@ -41,6 +49,36 @@ type BuildInfo struct {
 	Target  string `yaml:"target"`
 	NoCache bool   `yaml:"no_cache"`
 	Verbose bool   `yaml:"verbose"`
+
+	// Upper limit of the build context size such as `500MB`. No limit if empty.
+	MaxContextSize string `yaml:"max_context_size"`
+
+	// The number of the largest files and directories shown when the context exceeds the limit.
+	ContextTop int `yaml:"context_top"`
+
+	// Whether to compress the build context with gzip before sending it.
+	Compress bool `yaml:"compress"`
+
+	// Images used as cache sources on build without buildkit
+	CacheFrom []string `yaml:"cache_from"`
+
+	// Progress output mode, one of auto, tty, plain, json or quiet
+	Progress string `yaml:"progress"`
+
+	// Whether to show the summary of the build steps after build
+	Summary bool `yaml:"summary"`
+
+	// Uncached steps taking longer than this such as `30s` are highlighted in the summary
+	SlowStep string `yaml:"slow_step"`
+
+	// Template of the log file into which the output is copied, such as `logs/build-{{.Image}}-{{.Date}}.log`
+	LogFile string `yaml:"log_file"`
+
+	// The number of the log files kept for each image. The older files are removed. No rotation if zero.
+	LogKeep int `yaml:"log_keep"`
+
+	// Upper limit of the time of build such as `30m`. No limit if empty.
+	Timeout string `yaml:"timeout"`
 }
 
 // NewBuildInfo makes Configuration struct with default values.
@@ -48,72 +86,97 @@ func NewBuildInfo() *BuildInfo {
 	build := new(BuildInfo)
 	build.Verbose = true
 	build.NoCache = false
+	build.ContextTop = 10
+	build.Progress = ProgressAuto
+	build.Summary = true
+	build.SlowStep = defaultSlowStep.String()
+	build.LogKeep = 10
 	return build
 }
 
-// LoadConfig loads the configuration from the path.
-func LoadConfig(path string) (conf *Configuration) {
-	conf = NewConfiguration()
-	data, err := ioutil.ReadFile(path)
+// SlowStepThreshold returns slow_step as duration. Zero disables highlighting the slow steps.
+func (build *BuildInfo) SlowStepThreshold() (time.Duration, error) {
+	if build.SlowStep == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(build.SlowStep)
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("invalid slow_step %q: %v", build.SlowStep, err)
+	}
+	return d, nil
+}
+
+// TimeoutDuration returns the timeout of build phase, or zero if the timeout is not set.
+func (build *BuildInfo) TimeoutDuration() (time.Duration, error) {
+	return parseTimeout("build.timeout", build.Timeout)
+}
+
+// PushInfo defines the options on image push.
+type PushInfo struct {
+	// Upper limit of the time of push such as `10m`. No limit if empty.
+	Timeout string `yaml:"timeout"`
+}
+
+// TimeoutDuration returns the timeout of push phase, or zero if the timeout is not set.
+func (push *PushInfo) TimeoutDuration() (time.Duration, error) {
+	return parseTimeout("push.timeout", push.Timeout)
+}
+
+// ContextLimit returns max_context_size in bytes, or zero if the limit is not set.
+func (build *BuildInfo) ContextLimit() (int64, error) {
+	if build.MaxContextSize == "" {
+		return 0, nil
 	}
-	rep, err := parseEnv(string(data))
+	limit, err := units.RAMInBytes(build.MaxContextSize)
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("invalid max_context_size %q: %v", build.MaxContextSize, err)
 	}
-	if err = yaml.Unmarshal([]byte(rep), &conf); err != nil {
-		panic(err)
+	return limit, nil
+}
+
+// CheckContext checks the size of the build context in dir does not exceed max_context_size.
+func (build *BuildInfo) CheckContext(dir string) error {
+	limit, err := build.ContextLimit()
+	if err != nil {
+		return err
 	}
-	conf.ImageInfo.SetProperties()
-	return conf
+	return CheckContextSize(dir, limit, build.ContextTop)
 }
 
-// ConfigExists checks if the input config exists.
-func ConfigExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
+// PrepareContext compresses the tar archive of the build context in dir if compress is enabled.
+func (build *BuildInfo) PrepareContext(dir string, buf *bytes.Buffer) (*bytes.Buffer, error) {
+	if !build.Compress {
+		return buf, nil
+	}
+	compressed, err := CompressContext(buf)
+	if err != nil {
+		return nil, err
+	}
+	ShowCompressRatio(dir, buf.Len(), compressed.Len())
+	return compressed, nil
 }
 
-func parseEnv(data string) (string, error) {
-	matches := regexp.MustCompile(`\${.*}`).FindAllString(data, -1)
-	res, err := getEnvs(matches)
+// LoadConfig loads the configuration from the path, merged with the files it extends and includes.
+// The overlay of the profile is applied if profile is not empty, and envFiles are loaded before the env files in config.
+func LoadConfig(path string, profile string, envFiles []string) (*Configuration, error) {
+	conf := NewConfiguration()
+	file, err := ReadConfigFile(path, envFiles)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	for k, v := range res {
-		data = regexp.MustCompile(fmt.Sprintf(`\%v`, k)).ReplaceAllString(data, v)
+	if err = file.ApplyProfile(profile); err != nil {
+		return nil, err
 	}
-	return data, nil
+	conf.Profile = profile
+	if err = file.Decode(conf); err != nil {
+		return nil, err
+	}
+	conf.ImageInfo.SetProperties()
+	return conf, nil
 }
 
-// getEnvs replaces the specified variables in environment variables.
-// If the environment variable is not defined and the default value is not set, returns error.
-func getEnvs(envs []string) (map[string]string, error) {
-	var target, def string
-	res := map[string]string{}
-	for _, env := range envs {
-		e := regexp.MustCompile("[${}]").ReplaceAllString(env, "")
-
-		// Split env and its default value.
-		arr := regexp.MustCompile("(:-)").Split(e, -1)
-		if len(arr) == 1 {
-			target = arr[0]
-			def = ""
-		} else if len(arr) == 2 {
-			target = arr[0]
-			def = regexp.MustCompile("[${}]").ReplaceAllString(arr[1], "")
-		}
-
-		// Get the env value.
-		rep := os.Getenv(target)
-		if rep == "" {
-			if def == "" {
-				return res, fmt.Errorf(fmt.Sprintf("ENV %v not defined.", env))
-			}
-			rep = def
-		}
-		res[env] = rep
-	}
-	return res, nil
+// ConfigExists checks if the input config exists.
+func ConfigExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
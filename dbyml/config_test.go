@@ -3,7 +3,6 @@ package dbyml
 import (
 	"encoding/base64"
 	"encoding/json"
-	"os"
 
 	// "fmt"
 	"testing"
@@ -22,38 +21,15 @@ func TestRegistry(t *testing.T) {
 func TestEncodeDecoder(t *testing.T) {
 	registry := NewRegistryInfo()
 	auth := map[string]string{"username": "docker", "password": "docker"}
-	registry.Auth = auth
-	encode := registry.BasicAuth()
+	registry.Auth = map[string]*SecretValue{"username": NewSecretValue("docker"), "password": NewSecretValue("docker")}
+	encode, err := registry.BasicAuth()
+	assert.Nil(t, err)
 	b, _ := base64.URLEncoding.DecodeString(encode)
 	var decode map[string]string
-	err := json.Unmarshal(b, &decode)
+	err = json.Unmarshal(b, &decode)
 	if err != nil {
 		panic(err)
 	}
 
 	assert.Equal(t, auth, decode)
 }
-
-func TestParseEnv(t *testing.T) {
-	os.Setenv("TEST", "en_US.UTF-8")
-	os.Unsetenv("DUMMY")
-
-	data := `
-	test1: ${TEST}
-	test2: ${DUMMY:-default}`
-	res, err := parseEnv(data)
-	if err != nil {
-		panic(err)
-	}
-
-	expected := `
-	test1: en_US.UTF-8
-	test2: default`
-	assert.Equal(t, res, expected)
-	os.Unsetenv("TEST")
-
-	_, err = parseEnv(data)
-	if err != nil {
-		assert.Equal(t, err.Error(), "ENV ${TEST} not defined.")
-	}
-}
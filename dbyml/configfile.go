@@ -0,0 +1,500 @@
+package dbyml
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The suffix of key to append the list to the inherited list instead of replacing it, such as `cache_from+`.
+const appendMarker = "+"
+
+// The origin of the settings not written in any config file
+const defaultOrigin = "default"
+
+// ConfigFile is the settings merged from a config file and the files it extends and includes.
+//
+// A config file inherits the settings of the file of `extends`, and then the files of `include` in order.
+// The settings of the later file are merged into the earlier one: the maps are merged deeply, and the other
+// values are replaced. The list of the key with `+` suffix such as `cache_from+` is appended to the inherited
+// list instead of replacing it. The key with empty value does not override the inherited value.
+type ConfigFile struct {
+	Path     string
+	Settings yaml.MapSlice
+
+	// The file from which each value comes, by the key such as `image.name` or `build.cache_from[0]`
+	Origins map[string]string
+
+	// The overlays of each profile in order of merge, which are applied by ApplyProfile
+	profiles map[string][]configLayer
+}
+
+// configLayer is the settings written in a config file.
+type configLayer struct {
+	Settings yaml.MapSlice
+	Origin   string
+}
+
+// ReadConfigFile reads the config file, and merges the files it extends and includes.
+// The paths in extends and include are relative to the directory of the file.
+//
+// The environment variables in the files are replaced with the values in the following order of precedence:
+// the environment variables of the process, the env files of envFiles, and then the env files of env_file
+// in the config file and the files including it. The variables already defined are not overridden by env files.
+func ReadConfigFile(path string, envFiles []string) (*ConfigFile, error) {
+	values, err := LoadEnvFiles(envFiles, os.LookupEnv, false)
+	if err != nil {
+		return nil, err
+	}
+	file := &ConfigFile{Path: path, Origins: map[string]string{}, profiles: map[string][]configLayer{}}
+	if err := file.merge(path, nil, withEnvValues(os.LookupEnv, values)); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// merge merges the file and the files it extends and includes into the settings.
+// stack is the files including the file, which is used to detect circular includes,
+// and lookup is the environment variables for the file.
+func (file *ConfigFile) merge(path string, stack []string, lookup envLookup) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for i, p := range stack {
+		if p == abs {
+			chain := append(append([]string{}, stack[i:]...), abs)
+			for j := range chain {
+				chain[j] = displayPath(chain[j])
+			}
+			return fmt.Errorf("circular include: %v", strings.Join(chain, " -> "))
+		}
+	}
+	stack = append(stack, abs)
+
+	layer, err := readConfigLayer(path, lookup)
+	if err != nil {
+		return err
+	}
+	for _, parent := range layer.Parents {
+		if !filepath.IsAbs(parent) {
+			parent = filepath.Join(filepath.Dir(path), parent)
+		}
+		if err := file.merge(parent, stack, layer.Env); err != nil {
+			return err
+		}
+	}
+	origin := displayPath(abs)
+	merged, err := mergeSettings(file.Settings, layer.Settings, "", origin, file.Origins)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	file.Settings = merged
+	for _, item := range layer.Profiles {
+		name := fmt.Sprint(item.Key)
+		overlay, _ := item.Value.(yaml.MapSlice)
+		file.profiles[name] = append(file.profiles[name], configLayer{Settings: overlay, Origin: origin})
+	}
+	return nil
+}
+
+// Profiles returns the names of the profiles defined in the config files in sorted order.
+func (file *ConfigFile) Profiles() []string {
+	names := []string{}
+	for name := range file.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyProfile merges the overlays of the profile into the settings in the same way as the config files.
+// The profile is applied after all the files are merged, so the lists of the keys with `+` in the profile are
+// appended to the merged list. Nothing is applied if name is empty.
+func (file *ConfigFile) ApplyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	layers, ok := file.profiles[name]
+	if !ok {
+		available := "none"
+		if names := file.Profiles(); len(names) > 0 {
+			available = strings.Join(names, ", ")
+		}
+		return fmt.Errorf("profile %q not found in %v (available: %v)", name, file.Path, available)
+	}
+	for _, layer := range layers {
+		origin := fmt.Sprintf("%v (profile %v)", layer.Origin, name)
+		merged, err := mergeSettings(file.Settings, layer.Settings, "", origin, file.Origins)
+		if err != nil {
+			return fmt.Errorf("%v: profile %v: %v", layer.Origin, name, err)
+		}
+		file.Settings = merged
+	}
+	return nil
+}
+
+// configLayerFile is the config file read by readConfigLayer.
+type configLayerFile struct {
+	Settings yaml.MapSlice
+
+	// The files of extends and include in order of merge
+	Parents []string
+
+	// The profiles written in the file
+	Profiles yaml.MapSlice
+
+	// The lookup of the environment variables including the env files, which is used for the parents
+	Env envLookup
+}
+
+// readConfigLayer reads the settings in the config file after replacing the environment variables by lookup
+// and the env files written in the file.
+func readConfigLayer(path string, lookup envLookup) (*configLayerFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// The env files are loaded before replacing the environment variables, so env_file is read from the file as it is.
+	envFiles, err := configEnvFiles(path, data)
+	if err != nil {
+		return nil, err
+	}
+	values, err := LoadEnvFiles(envFiles, lookup, true)
+	if err != nil {
+		return nil, err
+	}
+	layer := &configLayerFile{Settings: yaml.MapSlice{}, Parents: []string{}, Env: withEnvValues(lookup, values)}
+
+	rep, err := expandEnv(string(data), layer.Env)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	var all yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(rep), &all); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	for _, item := range all {
+		switch item.Key {
+		case "extends":
+			parent, ok := item.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v: extends must be a path to config file", path)
+			}
+			layer.Parents = append([]string{parent}, layer.Parents...)
+		case "include":
+			includes, err := stringList(item.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%v: include must be a list of paths to config files", path)
+			}
+			layer.Parents = append(layer.Parents, includes...)
+		case "env_file":
+			// Loaded by configEnvFiles.
+		case "profiles":
+			if item.Value == nil {
+				continue
+			}
+			profiles, ok := item.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("%v: profiles must be a map of profile name to settings", path)
+			}
+			for _, profile := range profiles {
+				if _, ok := profile.Value.(yaml.MapSlice); profile.Value != nil && !ok {
+					return nil, fmt.Errorf("%v: profile %v must be a map of settings", path, profile.Key)
+				}
+			}
+			layer.Profiles = profiles
+		default:
+			layer.Settings = append(layer.Settings, item)
+		}
+	}
+	for i, parent := range layer.Parents {
+		if layer.Parents[i], err = expandHome(parent); err != nil {
+			return nil, err
+		}
+	}
+	return layer, nil
+}
+
+// configEnvFiles returns the paths of env_file in the config file, which are relative to the directory of the file.
+func configEnvFiles(path string, data []byte) ([]string, error) {
+	var conf struct {
+		EnvFile interface{} `yaml:"env_file"`
+	}
+	// The file which is not valid before replacing the environment variables is reported after that.
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, nil
+	}
+	files, err := stringList(conf.EnvFile)
+	if err != nil {
+		return nil, fmt.Errorf("%v: env_file must be a list of paths to env files", path)
+	}
+	for i, f := range files {
+		if f, err = expandHome(f); err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(filepath.Dir(path), f)
+		}
+		files[i] = f
+	}
+	return files, nil
+}
+
+// stringList returns the value as the list of strings, where a string is a list of one element.
+func stringList(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		list := []string{}
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v is not a string", e)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("%v is not a list", value)
+}
+
+// mergeSettings merges src into dst, and records the origin of each value merged from src.
+// prefix is the key of dst such as `image`, which is empty at the top level.
+func mergeSettings(dst yaml.MapSlice, src yaml.MapSlice, prefix string, origin string, origins map[string]string) (yaml.MapSlice, error) {
+	merged := append(yaml.MapSlice{}, dst...)
+	for _, item := range src {
+		key := fmt.Sprint(item.Key)
+		appendList := len(key) > len(appendMarker) && strings.HasSuffix(key, appendMarker)
+		key = strings.TrimSuffix(key, appendMarker)
+		path := joinKey(prefix, key)
+		if item.Value == nil {
+			continue
+		}
+
+		i := indexOfKey(merged, key)
+		var current interface{}
+		if i >= 0 {
+			current = merged[i].Value
+		}
+		value := item.Value
+		switch {
+		case appendList:
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%v%v must be a list", path, appendMarker)
+			}
+			inherited, ok := current.([]interface{})
+			if current != nil && !ok {
+				return nil, fmt.Errorf("%v%v cannot append to %v which is not a list", path, appendMarker, path)
+			}
+			for j, e := range list {
+				recordOrigins(fmt.Sprintf("%v[%d]", path, len(inherited)+j), e, origin, origins)
+			}
+			value = append(append([]interface{}{}, inherited...), list...)
+		default:
+			srcMap, srcIsMap := value.(yaml.MapSlice)
+			dstMap, dstIsMap := current.(yaml.MapSlice)
+			// The secret reference such as `{file: path}` is a value replacing the inherited one as a whole.
+			if srcIsMap && !isSecretRef(path, srcMap) {
+				// The map replacing other value is merged into empty map to handle the keys with `+` in it.
+				if !dstIsMap {
+					clearOrigins(path, origins)
+					dstMap = nil
+				}
+				if len(srcMap) == 0 && len(dstMap) == 0 {
+					origins[path] = origin
+				}
+				m, err := mergeSettings(dstMap, srcMap, path, origin, origins)
+				if err != nil {
+					return nil, err
+				}
+				value = m
+			} else {
+				clearOrigins(path, origins)
+				recordOrigins(path, value, origin, origins)
+			}
+		}
+		if i >= 0 {
+			merged[i].Value = value
+		} else {
+			merged = append(merged, yaml.MapItem{Key: key, Value: value})
+		}
+	}
+	return merged, nil
+}
+
+// The settings whose values are SecretValue, such as image.build_args.NPM_TOKEN
+var secretValueParents = []string{"image.build_args", "registry.auth"}
+
+// isSecretValueKey returns true if the value of the key is SecretValue.
+func isSecretValueKey(path string) bool {
+	i := strings.LastIndex(path, ".")
+	return i >= 0 && contains(secretValueParents, path[:i])
+}
+
+// isSecretRef returns true if the map is a reference of SecretValue such as `{file: path}`,
+// which has one of the keys file, env and command as the value of SecretValue.
+func isSecretRef(path string, m yaml.MapSlice) bool {
+	if len(m) != 1 || !isSecretValueKey(path) {
+		return false
+	}
+	switch m[0].Key {
+	case "file", "env", "command":
+		return true
+	}
+	return false
+}
+
+func joinKey(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func indexOfKey(settings yaml.MapSlice, key string) int {
+	for i, item := range settings {
+		if fmt.Sprint(item.Key) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordOrigins records the origin of the value of the key, or of each value in it if the value is a map or list.
+func recordOrigins(path string, value interface{}, origin string, origins map[string]string) {
+	if m, ok := value.(yaml.MapSlice); ok && len(m) > 0 {
+		for _, item := range m {
+			recordOrigins(joinKey(path, fmt.Sprint(item.Key)), item.Value, origin, origins)
+		}
+		return
+	}
+	if list, ok := value.([]interface{}); ok && len(list) > 0 {
+		for i := range list {
+			origins[fmt.Sprintf("%v[%d]", path, i)] = origin
+		}
+		return
+	}
+	origins[path] = origin
+}
+
+// clearOrigins removes the origins of the key and the values in it, which are replaced.
+func clearOrigins(path string, origins map[string]string) {
+	for key := range origins {
+		if key == path || strings.HasPrefix(key, path+".") || strings.HasPrefix(key, path+"[") {
+			delete(origins, key)
+		}
+	}
+}
+
+// Origin returns the file from which the value of the key comes, or `default` if not written in any file.
+func (file *ConfigFile) Origin(key string) string {
+	if origin, ok := file.Origins[key]; ok {
+		return origin
+	}
+	return defaultOrigin
+}
+
+// Decode sets the merged settings into the configuration.
+func (file *ConfigFile) Decode(conf *Configuration) error {
+	b, err := yaml.Marshal(file.Settings)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(b, conf); err != nil {
+		return fmt.Errorf("%v: %v", file.Path, err)
+	}
+	return nil
+}
+
+// Show writes the merged settings in yaml. If origin is true, each value is followed by the file it comes from.
+func (file *ConfigFile) Show(w io.Writer, origin bool) error {
+	return showSettings(w, file.Settings, "", 0, func(key string) string {
+		if !origin {
+			return ""
+		}
+		return "  # " + file.Origin(key)
+	})
+}
+
+func showSettings(w io.Writer, settings yaml.MapSlice, prefix string, depth int, comment func(string) string) error {
+	indent := strings.Repeat("  ", depth)
+	for _, item := range settings {
+		key := fmt.Sprint(item.Key)
+		path := joinKey(prefix, key)
+		switch v := item.Value.(type) {
+		case yaml.MapSlice:
+			if len(v) == 0 {
+				fmt.Fprintf(w, "%v%v: {}%v\n", indent, key, comment(path))
+				continue
+			}
+			fmt.Fprintf(w, "%v%v:\n", indent, key)
+			if err := showSettings(w, v, path, depth+1, comment); err != nil {
+				return err
+			}
+		case []interface{}:
+			if len(v) == 0 {
+				fmt.Fprintf(w, "%v%v: []%v\n", indent, key, comment(path))
+				continue
+			}
+			fmt.Fprintf(w, "%v%v:\n", indent, key)
+			for i, e := range v {
+				lines, err := yamlLines(e)
+				if err != nil {
+					return err
+				}
+				for j, line := range lines {
+					if j == 0 {
+						fmt.Fprintf(w, "%v- %v%v\n", indent, line, comment(fmt.Sprintf("%v[%d]", path, i)))
+					} else {
+						fmt.Fprintf(w, "%v  %v\n", indent, line)
+					}
+				}
+			}
+		default:
+			lines, err := yamlLines(v)
+			if err != nil {
+				return err
+			}
+			// The values of SecretValue written directly may come from the environment variables.
+			if isSecretValueKey(path) && path != "registry.auth.username" {
+				lines = []string{redactedValue}
+			}
+			fmt.Fprintf(w, "%v%v: %v%v\n", indent, key, Redact(lines[0]), comment(path))
+			for _, line := range lines[1:] {
+				fmt.Fprintf(w, "%v%v\n", indent, Redact(line))
+			}
+		}
+	}
+	return nil
+}
+
+// yamlLines returns the lines of the value in yaml.
+func yamlLines(value interface{}) ([]string, error) {
+	b, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"), nil
+}
+
+// displayPath returns the path relative to the current directory if possible.
+func displayPath(path string) string {
+	if wd, err := filepath.Abs("."); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return path
+}
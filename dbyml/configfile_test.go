@@ -0,0 +1,297 @@
+package dbyml
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigFiles writes the config files into a temporary directory, which becomes the current directory.
+func writeConfigFiles(t *testing.T, files map[string]string) {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0o644))
+	}
+	pwd, _ := os.Getwd()
+	os.Chdir(dir)
+	t.Cleanup(func() { os.Chdir(pwd) })
+}
+
+func TestReadConfigFile(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"base/dbyml.yml": `
+image:
+  name: base
+  tag: "1.0"
+  build_args:
+    GO_VERSION: "1.18"
+    CGO_ENABLED: "0"
+build:
+  cache_from:
+    - reg/base:cache
+  target: release
+registry:
+  auth:
+    username: ci
+    password: base
+`,
+		"shared/labels.yml": `
+image:
+  label:
+    team: platform
+build:
+  target: test
+`,
+		"app/dbyml.yml": `
+extends: ../base/dbyml.yml
+include:
+  - ../shared/labels.yml
+image:
+  name: app
+  build_args:
+    CGO_ENABLED: "1"
+  label:
+build:
+  cache_from+:
+    - reg/app:cache
+registry:
+  auth:
+    password: app
+`,
+	})
+
+	file, err := ReadConfigFile("app/dbyml.yml", nil)
+	assert.Nil(t, err)
+	conf := NewConfiguration()
+	assert.Nil(t, file.Decode(conf))
+
+	assert.Equal(t, "app", conf.ImageInfo.Basename)
+	assert.Equal(t, "1.0", conf.ImageInfo.Tag)
+	assert.Equal(t, map[string]*SecretValue{"GO_VERSION": NewSecretValue("1.18"), "CGO_ENABLED": NewSecretValue("1")}, conf.ImageInfo.BuildArgs)
+	assert.Equal(t, map[string]string{"team": "platform"}, conf.ImageInfo.Labels)
+	assert.Equal(t, []string{"reg/base:cache", "reg/app:cache"}, conf.BuildInfo.CacheFrom)
+	assert.Equal(t, "test", conf.BuildInfo.Target)
+	assert.Equal(t, map[string]*SecretValue{"username": NewSecretValue("ci"), "password": NewSecretValue("app")}, conf.RegistryInfo.Auth)
+	// The defaults not written in any file
+	assert.Equal(t, "Dockerfile", conf.ImageInfo.Dockerfile)
+
+	assert.Equal(t, "app/dbyml.yml", file.Origin("image.name"))
+	assert.Equal(t, "base/dbyml.yml", file.Origin("image.tag"))
+	assert.Equal(t, "base/dbyml.yml", file.Origin("image.build_args.GO_VERSION"))
+	assert.Equal(t, "app/dbyml.yml", file.Origin("image.build_args.CGO_ENABLED"))
+	assert.Equal(t, "shared/labels.yml", file.Origin("image.label.team"))
+	assert.Equal(t, "base/dbyml.yml", file.Origin("build.cache_from[0]"))
+	assert.Equal(t, "app/dbyml.yml", file.Origin("build.cache_from[1]"))
+	assert.Equal(t, "shared/labels.yml", file.Origin("build.target"))
+	assert.Equal(t, "default", file.Origin("image.dockerfile"))
+}
+
+func TestReadConfigFileReplaceList(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"base.yml": `
+build:
+  cache_from: [reg/base:cache, reg/base:main]
+`,
+		"dbyml.yml": `
+extends: base.yml
+build:
+  cache_from: [reg/app:cache]
+`,
+	})
+	file, err := ReadConfigFile("dbyml.yml", nil)
+	assert.Nil(t, err)
+	conf := NewConfiguration()
+	assert.Nil(t, file.Decode(conf))
+	assert.Equal(t, []string{"reg/app:cache"}, conf.BuildInfo.CacheFrom)
+	assert.Equal(t, "dbyml.yml", file.Origin("build.cache_from[0]"))
+	assert.Equal(t, "default", file.Origin("build.cache_from[1]"))
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"a.yml":       "extends: b.yml\n",
+		"b.yml":       "include: [c.yml]\n",
+		"c.yml":       "extends: a.yml\n",
+		"missing.yml": "extends: notexists.yml\n",
+		"base.yml":    "build:\n  target: test\n",
+		"append.yml":  "extends: base.yml\nbuild:\n  target+: [release]\n",
+		"scalar.yml":  "build:\n  cache_from+: reg/app:cache\n",
+	})
+
+	_, err := ReadConfigFile("a.yml", nil)
+	assert.EqualError(t, err, "circular include: a.yml -> b.yml -> c.yml -> a.yml")
+	_, err = ReadConfigFile("missing.yml", nil)
+	assert.True(t, os.IsNotExist(err))
+	_, err = ReadConfigFile("append.yml", nil)
+	assert.EqualError(t, err, "append.yml: build.target+ cannot append to build.target which is not a list")
+	_, err = ReadConfigFile("scalar.yml", nil)
+	assert.EqualError(t, err, "scalar.yml: build.cache_from+ must be a list")
+}
+
+func TestShowConfigFile(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"base.yml": `
+image:
+  name: base
+  tag: latest
+build:
+  cache_from:
+    - reg/base:cache
+`,
+		"dbyml.yml": `
+extends: base.yml
+image:
+  name: app
+build:
+  cache_from+:
+    - reg/app:cache
+`,
+	})
+	file, err := ReadConfigFile("dbyml.yml", nil)
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, file.Show(&buf, true))
+	expected := `image:
+  name: app  # dbyml.yml
+  tag: latest  # base.yml
+build:
+  cache_from:
+  - reg/base:cache  # base.yml
+  - reg/app:cache  # dbyml.yml
+`
+	assert.Equal(t, expected, buf.String())
+
+	buf.Reset()
+	assert.Nil(t, file.Show(&buf, false))
+	assert.NotContains(t, buf.String(), "#")
+}
+
+func TestApplyProfile(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"base.yml": `
+image:
+  name: app
+  label:
+    team: platform
+build:
+  cache_from: [reg/app:cache]
+profiles:
+  prod:
+    image:
+      label:
+        tier: release
+`,
+		"dbyml.yml": `
+extends: base.yml
+build:
+  no_cache: true
+registry:
+  enabled: true
+profiles:
+  dev:
+    build:
+      no_cache: false
+    registry:
+      enabled: false
+  prod:
+    build:
+      cache_from+: [reg/app:release]
+`,
+	})
+
+	file, err := ReadConfigFile("dbyml.yml", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dev", "prod"}, file.Profiles())
+	// The profiles are not applied without ApplyProfile.
+	conf := NewConfiguration()
+	assert.Nil(t, file.Decode(conf))
+	assert.True(t, conf.BuildInfo.NoCache)
+	assert.True(t, conf.RegistryInfo.Enabled)
+
+	assert.Nil(t, file.ApplyProfile("dev"))
+	conf = NewConfiguration()
+	assert.Nil(t, file.Decode(conf))
+	assert.False(t, conf.BuildInfo.NoCache)
+	assert.False(t, conf.RegistryInfo.Enabled)
+	assert.Equal(t, "dbyml.yml (profile dev)", file.Origin("build.no_cache"))
+
+	file, err = ReadConfigFile("dbyml.yml", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, file.ApplyProfile("prod"))
+	conf = NewConfiguration()
+	assert.Nil(t, file.Decode(conf))
+	assert.True(t, conf.BuildInfo.NoCache)
+	assert.Equal(t, map[string]string{"team": "platform", "tier": "release"}, conf.ImageInfo.Labels)
+	assert.Equal(t, []string{"reg/app:cache", "reg/app:release"}, conf.BuildInfo.CacheFrom)
+	assert.Equal(t, "base.yml (profile prod)", file.Origin("image.label.tier"))
+	assert.Equal(t, "dbyml.yml (profile prod)", file.Origin("build.cache_from[1]"))
+
+	assert.Nil(t, file.ApplyProfile(""))
+	assert.EqualError(t, file.ApplyProfile("staging"), `profile "staging" not found in dbyml.yml (available: dev, prod)`)
+}
+
+func TestReadConfigFileEnvFile(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"base/dbyml.yml": `
+image:
+  name: ${IMAGE_NAME}
+  tag: ${TAG}
+`,
+		"app/.env":       "IMAGE_NAME=app\nTAG=1.0\nREG_USER=ci\nREG_PASS=from-env-file\n",
+		"app/.env.local": "TAG=dev\n",
+		"app/dbyml.yml": `
+extends: ../base/dbyml.yml
+env_file:
+  - .env
+  - .env.local
+  - .env.notexists
+registry:
+  auth:
+    username: ${REG_USER}
+    password: ${REG_PASS}
+`,
+		"ci.env": "REG_PASS=from-cli\nIMAGE_NAME=ci\n",
+	})
+	t.Setenv("IMAGE_NAME", "from-process")
+
+	file, err := ReadConfigFile("app/dbyml.yml", []string{"ci.env"})
+	assert.Nil(t, err)
+	conf := NewConfiguration()
+	assert.Nil(t, file.Decode(conf))
+	// The environment variables of the process take precedence over --env-file, and then env_file.
+	assert.Equal(t, "from-process", conf.ImageInfo.Basename)
+	assert.Equal(t, "dev", conf.ImageInfo.Tag)
+	assert.Equal(t, map[string]*SecretValue{"username": NewSecretValue("ci"), "password": NewSecretValue("from-cli")}, conf.RegistryInfo.Auth)
+
+	// The env file given explicitly must exist.
+	_, err = ReadConfigFile("app/dbyml.yml", []string{"notexists.env"})
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"dbyml.yml":   "extends: loop.yml\nimage:\n  name: app\n",
+		"loop.yml":    "extends: dbyml.yml\n",
+		"profile.yml": "image:\n  name: app\nprofiles:\n  dev:\n    build:\n      no_cache: false\n",
+		"decode.yml":  "image:\n  name: [app]\n",
+	})
+
+	conf, err := LoadConfig("profile.yml", "dev", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "dev", conf.Profile)
+	assert.Equal(t, "app:latest", conf.ImageInfo.ImageName)
+
+	_, err = LoadConfig("dbyml.yml", "", nil)
+	assert.EqualError(t, err, "circular include: dbyml.yml -> loop.yml -> dbyml.yml")
+	_, err = LoadConfig("profile.yml", "prod", nil)
+	assert.EqualError(t, err, `profile "prod" not found in profile.yml (available: dev)`)
+	_, err = LoadConfig("decode.yml", "", nil)
+	assert.Contains(t, err.Error(), "decode.yml: yaml: unmarshal errors")
+}
@@ -3,12 +3,18 @@ package dbyml
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"time"
 
+	units "github.com/docker/go-units"
 	"github.com/moby/moby/pkg/fileutils"
 )
 
@@ -130,3 +136,208 @@ func GetBuildkitContext(dir string) (buf *bytes.Buffer) {
 	}
 	return buf
 }
+
+// AppendToContext returns a new tar archive of a build context with a file added at the root of the archive.
+func AppendToContext(buf *bytes.Buffer, name string, content []byte) (*bytes.Buffer, error) {
+	out := new(bytes.Buffer)
+	tw := tar.NewWriter(out)
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		ModTime: time.Now(),
+		Size:    int64(len(content)),
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CompressContext compresses the tar archive of a build context with gzip.
+// Both the docker daemon and CopyToContainer accept the gzip compressed archive.
+func CompressContext(buf *bytes.Buffer) (*bytes.Buffer, error) {
+	compressed := new(bytes.Buffer)
+	gw := gzip.NewWriter(compressed)
+	if _, err := gw.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return compressed, nil
+}
+
+// ShowCompressRatio shows the size of the raw and compressed build context to stdout.
+func ShowCompressRatio(dir string, raw int, compressed int) {
+	ratio := 0.0
+	if raw > 0 {
+		ratio = float64(compressed) / float64(raw) * 100
+	}
+	fmt.Printf(
+		"Compressed build context %v: %v -> %v (%.1f%%)\n",
+		dir, units.BytesSize(float64(raw)), units.BytesSize(float64(compressed)), ratio,
+	)
+}
+
+// extractTar extracts the files in a tar archive into dir, removing prefix from the name of each file.
+// The files and the links to the files outside dir are rejected, where the absolute target of a symlink
+// is taken as the path in dir and made relative. The entries other than files, directories and links fail.
+func extractTar(reader io.Reader, dir string, prefix string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	// The links are made relative to the real path of dir, so that they are not resolved outside dir.
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(hdr.Name, prefix)
+		path, err := joinInside(dir, name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			target := hdr.Linkname
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(name), target)
+			}
+			inside, err := joinInside(dir, target)
+			if err != nil {
+				return fmt.Errorf("link %v to %v: %v", hdr.Name, hdr.Linkname, err)
+			}
+			parent, err := realDirInside(dir, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(parent, inside)
+			if err != nil {
+				return err
+			}
+			if err := replaceFile(filepath.Join(parent, filepath.Base(path)), func(path string) error {
+				return os.Symlink(rel, path)
+			}); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := joinInside(dir, strings.TrimPrefix(hdr.Linkname, prefix))
+			if err != nil {
+				return fmt.Errorf("link %v to %v: %v", hdr.Name, hdr.Linkname, err)
+			}
+			if err := replaceFile(path, func(path string) error { return os.Link(target, path) }); err != nil {
+				return err
+			}
+		case tar.TypeXGlobalHeader:
+			// The header such as the commit id in the archive made by git is not a file.
+		default:
+			return fmt.Errorf("%v in the archive is not a file, directory or link (type %q)", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+// realDirInside creates the directory, and returns its path with the symlinks resolved,
+// which must be inside dir.
+func realDirInside(dir string, path string) (string, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil {
+		return "", err
+	}
+	return joinInside(dir, rel)
+}
+
+// replaceFile removes the file at path if it exists, and makes the new one by create.
+func replaceFile(path string, create func(path string) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return create(path)
+}
+
+// findTarEntry returns the reader of the file with the name in a tar archive.
+func findTarEntry(reader io.Reader, name string) (io.Reader, error) {
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%v not found in the archive", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			return tr, nil
+		}
+	}
+}
+
+// joinInside joins the path to dir, and returns error if the result is outside dir.
+func joinInside(dir string, path string) (string, error) {
+	joined := filepath.Join(dir, path)
+	rel, err := filepath.Rel(dir, joined)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %v is outside %v", path, dir)
+	}
+	return joined, nil
+}
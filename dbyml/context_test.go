@@ -0,0 +1,109 @@
+package dbyml
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressContext(t *testing.T) {
+	dir := makeContext(t, map[string]int{"Dockerfile": 10, "data/zero.bin": 64 * 1024})
+	raw := GetBuildkitContext(dir)
+	size := raw.Len()
+
+	build := NewBuildInfo()
+	buf, err := build.PrepareContext(dir, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, size, buf.Len())
+
+	build.Compress = true
+	buf, err = build.PrepareContext(dir, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Less(t, buf.Len(), size)
+
+	names := []string{}
+	for name := range readTar(t, buf) {
+		names = append(names, name)
+	}
+	assert.ElementsMatch(t, []string{"./Dockerfile", "./data/zero.bin"}, names)
+}
+
+func TestExtractTar(t *testing.T) {
+	dir := t.TempDir()
+	archive := makeTar(t, []tar.Header{
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "0123abc"}},
+		{Name: "export/", Typeflag: tar.TypeDir},
+		{Name: "export/bin/busybox", Typeflag: tar.TypeReg},
+		{Name: "export/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/busybox"},
+		{Name: "export/usr/bin/env", Typeflag: tar.TypeSymlink, Linkname: "../../bin/busybox"},
+		{Name: "export/bin/ash", Typeflag: tar.TypeLink, Linkname: "export/bin/busybox"},
+		{Name: "export/usr/lib/", Typeflag: tar.TypeDir},
+		{Name: "export/lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib"},
+		{Name: "export/self", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: "export/up", Typeflag: tar.TypeSymlink, Linkname: "self/.."},
+		{Name: "export/etc/", Typeflag: tar.TypeDir},
+		{Name: "export/conf", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		{Name: "export/conf/hosts", Typeflag: tar.TypeReg},
+		{Name: "export/lib/libc.so", Typeflag: tar.TypeReg},
+	})
+	assert.Nil(t, extractTar(archive, dir, "export/"))
+
+	for _, name := range []string{"bin/sh", "usr/bin/env", "bin/ash"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		assert.Equal(t, "data of export/bin/busybox", string(b))
+	}
+	// The absolute target is made relative not to point to the file on host.
+	target, _ := os.Readlink(filepath.Join(dir, "bin/sh"))
+	assert.Equal(t, "busybox", target)
+	assert.FileExists(t, filepath.Join(dir, "usr/lib/libc.so"))
+	// The target through another link is cleaned, so that it is not resolved outside dir.
+	target, _ = os.Readlink(filepath.Join(dir, "up"))
+	assert.Equal(t, ".", target)
+	// The file is not written outside dir through the link.
+	assert.FileExists(t, filepath.Join(dir, "etc/hosts"))
+}
+
+func TestExtractTarOutside(t *testing.T) {
+	tests := []struct {
+		entries  []tar.Header
+		expected string
+	}{
+		{
+			[]tar.Header{{Name: "../escape", Typeflag: tar.TypeReg}},
+			"path ../escape is outside %v",
+		},
+		{
+			[]tar.Header{{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../.."}},
+			"link up to ../..: path ../.. is outside %v",
+		},
+		{
+			[]tar.Header{{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"}},
+			"link passwd to ../etc/passwd: path ../etc/passwd is outside %v",
+		},
+		{
+			[]tar.Header{{Name: "null", Typeflag: tar.TypeChar}},
+			"null in the archive is not a file, directory or link (type '3')",
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		err := extractTar(makeTar(t, tt.entries), dir, "")
+		expected := tt.expected
+		if bytes.Contains([]byte(expected), []byte("%v")) {
+			resolved, _ := filepath.EvalSymlinks(dir)
+			expected = fmt.Sprintf(expected, resolved)
+		}
+		assert.EqualError(t, err, expected)
+	}
+}
@@ -0,0 +1,178 @@
+package dbyml
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	units "github.com/docker/go-units"
+)
+
+// ContextEntry describes a file or directory included in a build context.
+type ContextEntry struct {
+	Path string // Path relative to the context directory
+	Size int64  // Total size of the file or all files under the directory
+}
+
+// ContextSummary describes the files included in a build context after .dockerignore is applied.
+type ContextSummary struct {
+	Dir   string
+	Size  int64
+	Files []ContextEntry // Included files, largest first
+	Dirs  []ContextEntry // Directories containing included files, largest first
+}
+
+// ContextSizeError is returned when a build context exceeds the size limit.
+type ContextSizeError struct {
+	Dir   string
+	Size  int64
+	Limit int64
+}
+
+func (e *ContextSizeError) Error() string {
+	return fmt.Sprintf(
+		"build context %s is %s, which exceeds max_context_size %s",
+		e.Dir, units.BytesSize(float64(e.Size)), units.BytesSize(float64(e.Limit)),
+	)
+}
+
+// SummarizeContext walks the build context in the same way as GetBuildContext and
+// collects the size of the included files and directories.
+func SummarizeContext(dir string) (*ContextSummary, error) {
+	excludes, err := ReadDockerignore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &ContextSummary{Dir: dir}
+	dirs := map[string]int64{}
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if rm, _ := IsExclude(path, excludes); rm {
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			rel = filepath.Base(path)
+		}
+		rel = filepath.ToSlash(rel)
+		summary.Size += info.Size()
+		summary.Files = append(summary.Files, ContextEntry{rel, info.Size()})
+		for parent := filepath.Dir(rel); parent != "." && parent != "/"; parent = filepath.Dir(parent) {
+			dirs[parent] += info.Size()
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for k, v := range dirs {
+		summary.Dirs = append(summary.Dirs, ContextEntry{k, v})
+	}
+	sortEntries(summary.Files)
+	sortEntries(summary.Dirs)
+	return summary, nil
+}
+
+// Suggestions returns .dockerignore patterns which would exclude the largest entries in the context.
+// Directories are preferred to files, and entries covered by an already suggested directory are skipped.
+// Dockerfiles and .dockerignore are never suggested.
+func (summary *ContextSummary) Suggestions(top int) []string {
+	var patterns []string
+	covered := func(path string) bool {
+		base := filepath.Base(path)
+		if base == ".dockerignore" || strings.HasPrefix(base, "Dockerfile") {
+			return true
+		}
+		for _, p := range patterns {
+			if strings.HasPrefix(path, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, d := range limitEntries(summary.Dirs, top) {
+		if !covered(d.Path) {
+			patterns = append(patterns, d.Path)
+		}
+	}
+	for _, f := range limitEntries(summary.Files, top) {
+		if len(patterns) >= top {
+			break
+		}
+		if !covered(f.Path) {
+			patterns = append(patterns, f.Path)
+		}
+	}
+	if len(patterns) > top {
+		patterns = patterns[:top]
+	}
+	return patterns
+}
+
+// ShowReport shows the largest files and directories in the context and the suggested .dockerignore patterns to stdout.
+func (summary *ContextSummary) ShowReport(top int) {
+	fmt.Printf("Build context %s contains %d files, %s in total.\n",
+		summary.Dir, len(summary.Files), units.BytesSize(float64(summary.Size)))
+
+	if len(summary.Dirs) > 0 {
+		fmt.Printf("\nLargest directories:\n")
+		for _, d := range limitEntries(summary.Dirs, top) {
+			fmt.Printf("  %10s  %v/\n", units.BytesSize(float64(d.Size)), d.Path)
+		}
+	}
+	fmt.Printf("\nLargest files:\n")
+	for _, f := range limitEntries(summary.Files, top) {
+		fmt.Printf("  %10s  %v\n", units.BytesSize(float64(f.Size)), f.Path)
+	}
+
+	if patterns := summary.Suggestions(top); len(patterns) > 0 {
+		fmt.Printf("\nConsider adding the following patterns to %v:\n", filepath.Join(summary.Dir, ".dockerignore"))
+		for _, p := range patterns {
+			fmt.Printf("  %v\n", p)
+		}
+	}
+	fmt.Println()
+}
+
+// CheckContextSize returns ContextSizeError and shows the report of the largest entries
+// if the build context in dir exceeds limit bytes. A limit of zero or less disables the check.
+func CheckContextSize(dir string, limit int64, top int) error {
+	if limit <= 0 {
+		return nil
+	}
+	summary, err := SummarizeContext(dir)
+	if err != nil {
+		return err
+	}
+	if summary.Size > limit {
+		summary.ShowReport(top)
+		return &ContextSizeError{Dir: dir, Size: summary.Size, Limit: limit}
+	}
+	return nil
+}
+
+func sortEntries(entries []ContextEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Size == entries[j].Size {
+			return entries[i].Path < entries[j].Path
+		}
+		return entries[i].Size > entries[j].Size
+	})
+}
+
+func limitEntries(entries []ContextEntry, top int) []ContextEntry {
+	if top > 0 && len(entries) > top {
+		return entries[:top]
+	}
+	return entries
+}
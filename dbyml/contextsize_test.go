@@ -0,0 +1,58 @@
+package dbyml
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarizeContext(t *testing.T) {
+	dir := makeContext(t, map[string]int{
+		"Dockerfile":           10,
+		"data/large.bin":       1000,
+		"data/small.bin":       100,
+		"node_modules/a/x.js":  300,
+		"node_modules/b/y.js":  200,
+		"node_modules/b/z.js":  50,
+		"src/main.go":          20,
+		"src/internal/util.go": 5,
+	})
+
+	summary, err := SummarizeContext(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1685), summary.Size)
+	assert.Equal(t, 8, len(summary.Files))
+	assert.Equal(t, ContextEntry{"data/large.bin", 1000}, summary.Files[0])
+	assert.Equal(t, ContextEntry{"data", 1100}, summary.Dirs[0])
+	assert.Equal(t, ContextEntry{"node_modules", 550}, summary.Dirs[1])
+	assert.Equal(t, []string{"data", "node_modules"}, summary.Suggestions(2))
+	assert.Equal(t, []string{"data"}, summary.Suggestions(1))
+
+	// Files not covered by the suggested directories follow them.
+	summary.Dirs = summary.Dirs[:1]
+	assert.Equal(t, []string{"data", "node_modules/a/x.js", "node_modules/b/y.js"}, summary.Suggestions(3))
+}
+
+func TestCheckContextSize(t *testing.T) {
+	dir := makeContext(t, map[string]int{"Dockerfile": 10, "big.bin": 2048})
+
+	build := NewBuildInfo()
+	assert.Nil(t, build.CheckContext(dir))
+
+	build.MaxContextSize = "4k"
+	assert.Nil(t, build.CheckContext(dir))
+
+	build.MaxContextSize = "1k"
+	err := build.CheckContext(dir)
+	if assert.Error(t, err) {
+		sizeErr, ok := err.(*ContextSizeError)
+		assert.True(t, ok)
+		assert.Equal(t, int64(2058), sizeErr.Size)
+		assert.Equal(t, int64(1024), sizeErr.Limit)
+	}
+
+	build.MaxContextSize = "one gigabyte"
+	assert.Error(t, build.CheckContext(dir))
+}
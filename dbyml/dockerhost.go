@@ -0,0 +1,210 @@
+package dbyml
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// DockerEndpoint is the docker daemon which dbyml connects to.
+type DockerEndpoint struct {
+	Host      string // URL to the daemon such as tcp://127.0.0.1:2376
+	TLSVerify bool   // Verify the certificate of the daemon
+	CertPath  string // Directory containing ca.pem, cert.pem and key.pem, TLS is used if set
+	Context   string // Docker CLI context from which the endpoint is read, empty if not from a context
+}
+
+// ResolveDockerEndpoint resolves the docker daemon in the same order as the Docker CLI.
+//
+//  1. host, which is `docker_host` in config
+//  2. DOCKER_HOST
+//  3. The Docker CLI context of DOCKER_CONTEXT, or the current context in the Docker CLI config
+//  4. The default socket unix:///var/run/docker.sock
+//
+// For 1, 2 and 4, TLS is configured by tlsVerify and certPath, or DOCKER_TLS_VERIFY and DOCKER_CERT_PATH if not set.
+// The leading `~` of certPath is replaced with the home directory.
+// For 3, TLS is configured by the context.
+func ResolveDockerEndpoint(host string, tlsVerify bool, certPath string) (DockerEndpoint, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		name, err := currentDockerContext()
+		if err != nil {
+			return DockerEndpoint{}, err
+		}
+		if name != "" && name != "default" {
+			return loadDockerContext(name)
+		}
+		host = client.DefaultDockerHost
+	}
+
+	endpoint := DockerEndpoint{
+		Host:      host,
+		TLSVerify: tlsVerify || os.Getenv("DOCKER_TLS_VERIFY") != "",
+		CertPath:  certPath,
+	}
+	if endpoint.CertPath == "" {
+		endpoint.CertPath = os.Getenv("DOCKER_CERT_PATH")
+	}
+	if endpoint.CertPath == "" && endpoint.TLSVerify {
+		endpoint.CertPath = dockerConfigDir()
+	}
+	path, err := expandHome(endpoint.CertPath)
+	if err != nil {
+		return DockerEndpoint{}, err
+	}
+	endpoint.CertPath = path
+	return endpoint, nil
+}
+
+// IsLocalDockerHost returns true if the daemon of the docker host runs on this machine,
+// such as a unix socket or tcp on the loopback address, so that the files on this machine can be bind-mounted.
+func IsLocalDockerHost(host string) bool {
+	u, err := url.Parse(host)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "unix", "npipe":
+		return true
+	case "tcp", "http", "https":
+		ip := net.ParseIP(u.Hostname())
+		return u.Hostname() == "localhost" || (ip != nil && ip.IsLoopback())
+	}
+	return false
+}
+
+// NewDockerClient creates the client of Docker API connecting to the endpoint.
+// The daemon of `ssh://` host is connected through the system ssh binary, where TLS is not used.
+// All the clients in dbyml are created by this function so that they connect to the same daemon.
+func NewDockerClient(endpoint DockerEndpoint) (DockerAPI, error) {
+	if IsSSHHost(endpoint.Host) {
+		dialer, err := sshDialer(endpoint.Host)
+		if err != nil {
+			return nil, err
+		}
+		return newDockerClient(endpoint.Host,
+			client.WithHTTPClient(&http.Client{Transport: &http.Transport{DialContext: dialer}}),
+			client.WithHost(sshDummyHost),
+			client.WithDialContext(dialer),
+			client.WithAPIVersionNegotiation(),
+		)
+	}
+
+	opts := []client.Opt{}
+	if endpoint.CertPath != "" {
+		tlsc, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             existingFile(endpoint.CertPath, "ca.pem"),
+			CertFile:           existingFile(endpoint.CertPath, "cert.pem"),
+			KeyFile:            existingFile(endpoint.CertPath, "key.pem"),
+			InsecureSkipVerify: !endpoint.TLSVerify,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificates in %v: %v", endpoint.CertPath, err)
+		}
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport:     &http.Transport{TLSClientConfig: tlsc},
+			CheckRedirect: client.CheckRedirect,
+		}))
+	}
+	opts = append(opts, client.WithHost(endpoint.Host), client.WithAPIVersionNegotiation())
+	return newDockerClient(endpoint.Host, opts...)
+}
+
+func newDockerClient(host string, opts ...client.Opt) (DockerAPI, error) {
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %v: %v", host, err)
+	}
+	return cli, nil
+}
+
+// existingFile returns the path to the file in dir if exists, otherwise returns empty.
+func existingFile(dir string, name string) string {
+	path := filepath.Join(dir, name)
+	if !fileExists(path) {
+		return ""
+	}
+	return path
+}
+
+// dockerConfigDir returns the directory of the Docker CLI config, which is DOCKER_CONFIG or ~/.docker.
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker")
+}
+
+// currentDockerContext returns the name of Docker CLI context in use,
+// which is DOCKER_CONTEXT or currentContext in config.json of the Docker CLI.
+func currentDockerContext() (string, error) {
+	if name := os.Getenv("DOCKER_CONTEXT"); name != "" {
+		return name, nil
+	}
+	path := filepath.Join(dockerConfigDir(), "config.json")
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		CurrentContext string `json:"currentContext"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return "", fmt.Errorf("invalid %v: %v", path, err)
+	}
+	return config.CurrentContext, nil
+}
+
+// loadDockerContext reads the docker endpoint of the Docker CLI context.
+// The metadata is stored in contexts/meta/<digest of name>/meta.json in the config directory,
+// and the TLS certificates in contexts/tls/<digest of name>/docker.
+func loadDockerContext(name string) (DockerEndpoint, error) {
+	digest := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(digest[:])
+	dir := filepath.Join(dockerConfigDir(), "contexts")
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "meta", id, "meta.json"))
+	if os.IsNotExist(err) {
+		return DockerEndpoint{}, fmt.Errorf("docker context %q not found", name)
+	}
+	if err != nil {
+		return DockerEndpoint{}, err
+	}
+	var meta struct {
+		Endpoints map[string]struct {
+			Host          string
+			SkipTLSVerify bool
+		}
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return DockerEndpoint{}, fmt.Errorf("invalid docker context %q: %v", name, err)
+	}
+	docker, ok := meta.Endpoints["docker"]
+	if !ok || docker.Host == "" {
+		return DockerEndpoint{}, fmt.Errorf("docker context %q has no docker endpoint", name)
+	}
+
+	endpoint := DockerEndpoint{Host: docker.Host, Context: name}
+	tlsDir := filepath.Join(dir, "tls", id, "docker")
+	if info, err := os.Stat(tlsDir); err == nil && info.IsDir() {
+		endpoint.CertPath = tlsDir
+		endpoint.TLSVerify = !docker.SkipTLSVerify
+	}
+	return endpoint, nil
+}
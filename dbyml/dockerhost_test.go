@@ -0,0 +1,110 @@
+package dbyml
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeDockerContext writes the metadata of Docker CLI context into the config directory,
+// and returns the directory of the TLS certificates of the context.
+func writeDockerContext(t *testing.T, configDir string, name string, meta string, tls bool) string {
+	digest := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(digest[:])
+	metaDir := filepath.Join(configDir, "contexts", "meta", id)
+	assert.Nil(t, os.MkdirAll(metaDir, 0o755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(metaDir, "meta.json"), []byte(meta), 0o644))
+	tlsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	if tls {
+		assert.Nil(t, os.MkdirAll(tlsDir, 0o755))
+	}
+	return tlsDir
+}
+
+func TestResolveDockerEndpoint(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", configDir)
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_CONTEXT", "")
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	t.Setenv("DOCKER_CERT_PATH", "")
+
+	tlsDir := writeDockerContext(t, configDir, "remote", `{"Name":"remote","Endpoints":{"docker":{"Host":"tcp://remote:2376","SkipTLSVerify":false}}}`, true)
+	writeDockerContext(t, configDir, "plain", `{"Name":"plain","Endpoints":{"docker":{"Host":"tcp://plain:2375","SkipTLSVerify":false}}}`, false)
+
+	// The default socket
+	endpoint, err := ResolveDockerEndpoint("", false, "")
+	assert.Nil(t, err)
+	assert.Equal(t, DockerEndpoint{Host: "unix:///var/run/docker.sock"}, endpoint)
+
+	// The current context in config.json
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(configDir, "config.json"), []byte(`{"currentContext":"remote"}`), 0o644))
+	endpoint, err = ResolveDockerEndpoint("", false, "")
+	assert.Nil(t, err)
+	assert.Equal(t, DockerEndpoint{Host: "tcp://remote:2376", TLSVerify: true, CertPath: tlsDir, Context: "remote"}, endpoint)
+
+	// DOCKER_CONTEXT overrides the current context.
+	t.Setenv("DOCKER_CONTEXT", "plain")
+	endpoint, err = ResolveDockerEndpoint("", false, "")
+	assert.Nil(t, err)
+	assert.Equal(t, DockerEndpoint{Host: "tcp://plain:2375", Context: "plain"}, endpoint)
+
+	// The default context is the default socket.
+	t.Setenv("DOCKER_CONTEXT", "default")
+	endpoint, err = ResolveDockerEndpoint("", false, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "unix:///var/run/docker.sock", endpoint.Host)
+
+	// DOCKER_HOST overrides the context, with TLS by the environment variables.
+	t.Setenv("DOCKER_CONTEXT", "remote")
+	t.Setenv("DOCKER_HOST", "tcp://env:2376")
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	endpoint, err = ResolveDockerEndpoint("", false, "")
+	assert.Nil(t, err)
+	assert.Equal(t, DockerEndpoint{Host: "tcp://env:2376", TLSVerify: true, CertPath: configDir}, endpoint)
+
+	// docker_host overrides all.
+	endpoint, err = ResolveDockerEndpoint("tcp://config:2376", false, "/certs")
+	assert.Nil(t, err)
+	assert.Equal(t, DockerEndpoint{Host: "tcp://config:2376", TLSVerify: true, CertPath: "/certs"}, endpoint)
+
+	// The context not found
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_CONTEXT", "notexists")
+	_, err = ResolveDockerEndpoint("", false, "")
+	assert.EqualError(t, err, `docker context "notexists" not found`)
+}
+
+func TestNewDockerClient(t *testing.T) {
+	_, err := NewDockerClient(DockerEndpoint{Host: "tcp://127.0.0.1:2375"})
+	assert.Nil(t, err)
+
+	_, err = NewDockerClient(DockerEndpoint{Host: "invalid"})
+	assert.NotNil(t, err)
+
+	// The certificate without the key
+	dir := t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte("invalid"), 0o644))
+	_, err = NewDockerClient(DockerEndpoint{Host: "tcp://127.0.0.1:2376", TLSVerify: true, CertPath: dir})
+	assert.Contains(t, err.Error(), "failed to load TLS certificates in "+dir)
+}
+
+func TestIsLocalDockerHost(t *testing.T) {
+	tests := map[string]bool{
+		"unix:///var/run/docker.sock":     true,
+		"npipe:////./pipe/docker_engine":  true,
+		"tcp://127.0.0.1:2375":            true,
+		"tcp://localhost:2375":            true,
+		"tcp://192.168.1.10:2376":         false,
+		"ssh://user@build-host":           false,
+		"https://docker.example.com:2376": false,
+	}
+	for host, expected := range tests {
+		assert.Equal(t, expected, IsLocalDockerHost(host), host)
+	}
+}
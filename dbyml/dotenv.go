@@ -0,0 +1,182 @@
+package dbyml
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// envLookup returns the value of the environment variable and whether it is defined.
+type envLookup func(key string) (string, bool)
+
+// withEnvValues returns the lookup which looks up the values after lookup, so that the values
+// do not override the variables already defined.
+func withEnvValues(lookup envLookup, values map[string]string) envLookup {
+	return func(key string) (string, bool) {
+		if v, ok := lookup(key); ok {
+			return v, ok
+		}
+		v, ok := values[key]
+		return v, ok
+	}
+}
+
+// LoadEnvFiles reads the dotenv files in order, where the value in the later file overrides the earlier one.
+// The variables in the values are expanded by lookup and the variables defined before them.
+// The file not found is skipped if optional is true.
+func LoadEnvFiles(paths []string, lookup envLookup, optional bool) (map[string]string, error) {
+	values := map[string]string{}
+	for _, path := range paths {
+		path, err := expandHome(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if optional && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if err := parseDotenv(string(data), lookup, values); err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	return values, nil
+}
+
+// parseDotenv parses the variables written as `KEY=VALUE` per line in the dotenv file, and sets them in values.
+//
+// The lines starting with `#` are comments, and `export` before the key is ignored.
+// The value in single quotes is used as it is. The value in double quotes may have the escapes
+// such as `\n` and `\"`, and both may span multiple lines. The variables in the value not in single
+// quotes are expanded in the same way as the config file, where the value without quotes ends at ` #`.
+// The variables are looked up by lookup and then in values.
+func parseDotenv(data string, lookup envLookup, values map[string]string) error {
+	e := &envExpander{lookup: withEnvValues(lookup, values)}
+	line := 1
+	for rest := data; rest != ""; {
+		text, next := cutLine(rest)
+		start := line
+		rest = next
+		line++
+
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+		eq := strings.IndexByte(text, '=')
+		if eq < 0 {
+			e.errorf(start, "%q is not KEY=VALUE", text)
+			continue
+		}
+		key := strings.TrimSpace(text[:eq])
+		if !isEnvName(key) {
+			e.errorf(start, "%q is not a valid variable name", key)
+			continue
+		}
+		value := strings.TrimLeft(text[eq+1:], " \t")
+
+		if value != "" && (value[0] == '\'' || value[0] == '"') {
+			// The quoted value may continue on the following lines.
+			quote := value[0]
+			quoted := value[1:]
+			end := closingQuote(quoted, quote)
+			for end < 0 && rest != "" {
+				more, next := cutLine(rest)
+				quoted += "\n" + more
+				rest = next
+				line++
+				end = closingQuote(quoted, quote)
+			}
+			if end < 0 {
+				e.errorf(start, "the value of %v is not closed by %c", key, quote)
+				break
+			}
+			if after := strings.TrimSpace(quoted[end+1:]); after != "" && !strings.HasPrefix(after, "#") {
+				e.errorf(start, "unexpected %q after the value of %v", after, key)
+				continue
+			}
+			if quote == '\'' {
+				values[key] = quoted[:end]
+			} else {
+				values[key] = e.expand(unescapeDotenv(quoted[:end]), start)
+			}
+			continue
+		}
+
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = value[:i]
+		}
+		values[key] = e.expand(strings.TrimSpace(value), start)
+	}
+	if len(e.err.Problems) > 0 {
+		return &e.err
+	}
+	return nil
+}
+
+// cutLine returns the first line of s and the rest after the newline.
+func cutLine(s string) (string, string) {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return strings.TrimSuffix(s[:i], "\r"), s[i+1:]
+	}
+	return strings.TrimSuffix(s, "\r"), ""
+}
+
+// closingQuote returns the index of the quote closing the value, or -1 if not found.
+// The quote escaped by `\` is skipped in double quotes.
+func closingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		if quote == '"' && s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			return i
+		}
+	}
+	return -1
+}
+
+// unescapeDotenv replaces the escapes in double quotes. `\$` is left as `$$`, which is a literal `$` on expansion.
+func unescapeDotenv(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case '$':
+			buf.WriteString("$$")
+		case '"', '\\':
+			buf.WriteByte(s[i])
+		default:
+			buf.WriteByte('\\')
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+func isEnvName(s string) bool {
+	if s == "" || !isNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
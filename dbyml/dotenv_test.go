@@ -0,0 +1,94 @@
+package dbyml
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDotenv(t *testing.T) {
+	data := `# registry credentials
+REG_USER=ci
+export REG_HOST = myregistry.com  # inline comment
+EMPTY=
+SINGLE='literal ${REG_USER} # not a comment'
+DOUBLE="user: ${REG_USER}\tat $REG_HOST \"quoted\" \$HOME"
+URL=https://${REG_HOST}/v2#anchor
+CERT="-----BEGIN CERTIFICATE-----
+MIIB
+-----END CERTIFICATE-----"
+KEY='line1
+line2'
+DEFAULT=${UNSET:-fallback}
+FROM_ENV=${HOME_DIR}
+`
+	lookup := func(key string) (string, bool) {
+		if key == "HOME_DIR" {
+			return "/home/ci", true
+		}
+		return "", false
+	}
+	values := map[string]string{}
+	assert.Nil(t, parseDotenv(data, lookup, values))
+	expected := map[string]string{
+		"REG_USER": "ci",
+		"REG_HOST": "myregistry.com",
+		"EMPTY":    "",
+		"SINGLE":   "literal ${REG_USER} # not a comment",
+		"DOUBLE":   "user: ci\tat myregistry.com \"quoted\" $HOME",
+		"URL":      "https://myregistry.com/v2#anchor",
+		"CERT":     "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----",
+		"KEY":      "line1\nline2",
+		"DEFAULT":  "fallback",
+		"FROM_ENV": "/home/ci",
+	}
+	assert.Equal(t, expected, values)
+}
+
+func TestParseDotenvErrors(t *testing.T) {
+	data := `A=1
+invalid line
+1B=2
+C="value" trailing
+D=${UNDEFINED}
+E="not closed
+F=3
+`
+	err := parseDotenv(data, func(string) (string, bool) { return "", false }, map[string]string{})
+	expected := `5 errors in environment variables:
+  line 2: "invalid line" is not KEY=VALUE
+  line 3: "1B" is not a valid variable name
+  line 4: unexpected "trailing" after the value of C
+  line 5: ${UNDEFINED} not defined
+  line 6: the value of E is not closed by "`
+	assert.EqualError(t, err, expected)
+}
+
+func TestLoadEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+	env := filepath.Join(dir, ".env")
+	local := filepath.Join(dir, ".env.local")
+	assert.Nil(t, ioutil.WriteFile(env, []byte("TAG=1.0\nUSER=ci\nIMAGE=app:${TAG}\n"), 0o644))
+	assert.Nil(t, ioutil.WriteFile(local, []byte("TAG=dev\nLOCAL_IMAGE=app:${TAG}\n"), 0o644))
+
+	// The later file overrides the earlier one, and the environment variables are not overridden.
+	lookup := func(key string) (string, bool) {
+		if key == "USER" {
+			return "me", true
+		}
+		return "", false
+	}
+	values, err := LoadEnvFiles([]string{env, local}, lookup, false)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"TAG": "dev", "USER": "ci", "IMAGE": "app:1.0", "LOCAL_IMAGE": "app:dev"}, values)
+
+	// The file not found
+	_, err = LoadEnvFiles([]string{filepath.Join(dir, "notexists")}, lookup, false)
+	assert.True(t, os.IsNotExist(err))
+	values, err = LoadEnvFiles([]string{env, filepath.Join(dir, "notexists")}, lookup, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.0", values["TAG"])
+}
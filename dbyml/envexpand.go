@@ -0,0 +1,235 @@
+package dbyml
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// EnvError is the error of the environment variables which could not be expanded in the config file.
+type EnvError struct {
+	// The problems with the line numbers on which they are found, such as `line 3: ${TAG} not defined`
+	Problems []string
+}
+
+func (e *EnvError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0]
+	}
+	return fmt.Sprintf("%v errors in environment variables:\n  %v", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// envExpander expands the environment variables in the text in the same way as shell.
+type envExpander struct {
+	lookup envLookup
+	err    EnvError
+}
+
+// expandEnv replaces the environment variables in data with the values by lookup.
+// The following forms are supported.
+//
+//	$VAR, ${VAR}   The value of VAR. An error if VAR is not defined, but an empty value is allowed.
+//	${VAR:-word}   word if VAR is not defined or empty.
+//	${VAR-word}    word if VAR is not defined.
+//	${VAR:?msg}    An error with msg if VAR is not defined or empty.
+//	${VAR?msg}     An error with msg if VAR is not defined.
+//	${VAR:+word}   word if VAR is defined and not empty, otherwise empty.
+//	${VAR+word}    word if VAR is defined, otherwise empty.
+//	$$             A literal $.
+//
+// word may contain other variables. A `$` not followed by a variable name is left as it is.
+// The comment lines of YAML are left as they are, so that a variable in the comment is not required.
+// All the problems are reported at once as EnvError.
+func expandEnv(data string, lookup envLookup) (string, error) {
+	e := &envExpander{lookup: lookup}
+	var buf strings.Builder
+	lines := strings.SplitAfter(data, "\n")
+	comments := commentLines(lines)
+	// The lines between the comments are expanded together, where a variable may span lines.
+	start := 0
+	for i := 0; i <= len(lines); i++ {
+		if i < len(lines) && !comments[i] {
+			continue
+		}
+		buf.WriteString(e.expand(strings.Join(lines[start:i], ""), start+1))
+		if i < len(lines) {
+			buf.WriteString(lines[i])
+		}
+		start = i + 1
+	}
+	if len(e.err.Problems) > 0 {
+		return "", &e.err
+	}
+	return buf.String(), nil
+}
+
+// The line starting the block scalar of YAML such as `script: |` or `- >-`
+var blockScalarPattern = regexp.MustCompile(`[:-]\s+[|>][-+1-9]*\s*(\s#.*)?$`)
+
+// commentLines returns whether each line is a comment of YAML, which starts with `#`.
+// The lines in the block scalar are the content even if they start with `#`.
+func commentLines(lines []string) []bool {
+	comments := make([]bool, len(lines))
+	blockIndent := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if blockIndent >= 0 {
+			if trimmed == "" || indent > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		switch {
+		case strings.HasPrefix(trimmed, "#"):
+			comments[i] = true
+		case blockScalarPattern.MatchString(strings.TrimRight(line, "\r\n")):
+			blockIndent = indent
+		}
+	}
+	return comments
+}
+
+// expand returns the text in which the variables are replaced. line is the line number on which the text starts.
+func (e *envExpander) expand(text string, line int) string {
+	var buf strings.Builder
+	for i := 0; i < len(text); {
+		c := text[i]
+		if c != '$' || i+1 == len(text) {
+			if c == '\n' {
+				line++
+			}
+			buf.WriteByte(c)
+			i++
+			continue
+		}
+		next := text[i+1]
+		switch {
+		case next == '$':
+			buf.WriteByte('$')
+			i += 2
+		case next == '{':
+			end := matchingBrace(text, i+2)
+			if end < 0 {
+				e.errorf(line, "%v is not closed", firstLine(text[i:]))
+				return buf.String()
+			}
+			buf.WriteString(e.expandBraced(text[i+2:end], line))
+			line += strings.Count(text[i:end], "\n")
+			i = end + 1
+		case isNameStart(next):
+			j := i + 2
+			for j < len(text) && isNameChar(text[j]) {
+				j++
+			}
+			name := text[i+1 : j]
+			if v, ok := e.lookup(name); ok {
+				buf.WriteString(v)
+			} else {
+				e.errorf(line, "$%v not defined", name)
+			}
+			i = j
+		default:
+			buf.WriteByte(c)
+			i++
+		}
+	}
+	return buf.String()
+}
+
+// expandBraced returns the value of the expression inside `${}`.
+func (e *envExpander) expandBraced(expr string, line int) string {
+	j := 0
+	for j < len(expr) && isNameChar(expr[j]) {
+		j++
+	}
+	name, rest := expr[:j], expr[j:]
+	if name == "" || !isNameStart(name[0]) {
+		e.errorf(line, "${%v} is not a valid variable", expr)
+		return ""
+	}
+	value, defined := e.lookup(name)
+	if rest == "" {
+		if !defined {
+			e.errorf(line, "${%v} not defined", name)
+		}
+		return value
+	}
+
+	// The operators with `:` treat the empty value in the same way as undefined.
+	set := defined
+	op := rest[0]
+	if op == ':' && len(rest) > 1 {
+		set = defined && value != ""
+		op = rest[1]
+		rest = rest[1:]
+	}
+	word := rest[1:]
+	switch op {
+	case '-':
+		if set {
+			return value
+		}
+		return e.expand(word, line)
+	case '+':
+		if set {
+			return e.expand(word, line)
+		}
+		return ""
+	case '?':
+		if set {
+			return value
+		}
+		msg := e.expand(word, line)
+		if msg == "" {
+			if defined {
+				msg = "empty"
+			} else {
+				msg = "not defined"
+			}
+		}
+		e.errorf(line, "${%v}: %v", name, msg)
+		return ""
+	}
+	e.errorf(line, "${%v} has unknown operator %q", expr, rest)
+	return ""
+}
+
+func (e *envExpander) errorf(line int, format string, args ...interface{}) {
+	e.err.Problems = append(e.err.Problems, fmt.Sprintf("line %v: ", line)+fmt.Sprintf(format, args...))
+}
+
+// matchingBrace returns the index of `}` closing the `${` before start, or -1 if not found.
+func matchingBrace(text string, start int) int {
+	depth := 1
+	for i := start; i < len(text); i++ {
+		switch {
+		case text[i] == '$' && i+1 < len(text) && text[i+1] == '$':
+			i++
+		case text[i] == '$' && i+1 < len(text) && text[i+1] == '{':
+			depth++
+			i++
+		case text[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || ('0' <= c && c <= '9')
+}
@@ -0,0 +1,146 @@
+package dbyml
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{"NAME": "app", "TAG": "1.0", "EMPTY": ""}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"name: ${NAME}", "name: app"},
+		{"name: $NAME", "name: app"},
+		{"image: ${NAME}:${TAG}", "image: app:1.0"},
+		{"image: $NAME-$TAG", "image: app-1.0"},
+		{"tag: ${EMPTY}", "tag: "},
+		{"tag: ${UNSET:-latest}", "tag: latest"},
+		{"tag: ${EMPTY:-latest}", "tag: latest"},
+		{"tag: ${TAG:-latest}", "tag: 1.0"},
+		{"tag: ${UNSET-latest}", "tag: latest"},
+		{"tag: ${EMPTY-latest}", "tag: "},
+		{"tag: ${UNSET:-${NAME}-dev}", "tag: app-dev"},
+		{"tag: ${TAG:?tag is required}", "tag: 1.0"},
+		{"tag: ${EMPTY?tag is required}", "tag: "},
+		{"tag: ${TAG:+release}", "tag: release"},
+		{"tag: ${EMPTY:+release}", "tag: "},
+		{"tag: ${EMPTY+release}", "tag: release"},
+		{"tag: ${UNSET+release}", "tag: "},
+		{"password: pa$$word", "password: pa$word"},
+		{"password: $${NAME}", "password: ${NAME}"},
+		{"price: 5$ or $1", "price: 5$ or $1"},
+		{"tag: ${UNSET:-{a}}", "tag: {a}"},
+	}
+	for _, tt := range tests {
+		res, err := expandEnv(tt.data, lookup)
+		assert.Nil(t, err, tt.data)
+		assert.Equal(t, tt.expected, res, tt.data)
+	}
+}
+
+func TestExpandEnvErrors(t *testing.T) {
+	env := map[string]string{"EMPTY": ""}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	data := `image:
+  name: ${NAME}
+  tag: $TAG
+build:
+  target: ${TARGET:?target is required}
+  platform: ${EMPTY:?}
+`
+	_, err := expandEnv(data, lookup)
+	expected := `4 errors in environment variables:
+  line 2: ${NAME} not defined
+  line 3: $TAG not defined
+  line 5: ${TARGET}: target is required
+  line 6: ${EMPTY}: empty`
+	assert.EqualError(t, err, expected)
+
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{"a: 1\nname: ${NAME", "line 2: ${NAME is not closed"},
+		{"name: ${1NAME}", "line 1: ${1NAME} is not a valid variable"},
+		{"name: ${NAME:=app}", `line 1: ${NAME:=app} has unknown operator "=app"`},
+		{"tag: ${UNSET:?}", "line 1: ${UNSET}: not defined"},
+	}
+	for _, tt := range tests {
+		_, err := expandEnv(tt.data, lookup)
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+// The comments are not expanded, so that the variable in them is not required.
+func TestExpandEnvComments(t *testing.T) {
+	lookup := func(key string) (string, bool) {
+		if key == "TAG" {
+			return "1.0", true
+		}
+		return "", false
+	}
+	data := `# set $FOO here
+image:
+  # tag: ${UNSET}
+  tag: $TAG
+  dockerfile_inline: |
+    FROM alpine:$TAG
+    # $TAG in the block is the content
+  label:
+    a: b
+`
+	res, err := expandEnv(data, lookup)
+	assert.Nil(t, err)
+	assert.Equal(t, `# set $FOO here
+image:
+  # tag: ${UNSET}
+  tag: 1.0
+  dockerfile_inline: |
+    FROM alpine:1.0
+    # 1.0 in the block is the content
+  label:
+    a: b
+`, res)
+
+	// The line numbers are counted across the comments.
+	_, err = expandEnv("# $FOO\nimage:\n  # $BAR\n  tag: $UNSET\n", lookup)
+	assert.EqualError(t, err, "line 4: $UNSET not defined")
+}
+
+func TestExpandEnvProcess(t *testing.T) {
+	t.Setenv("TEST", "en_US.UTF-8")
+	t.Setenv("EMPTY", "")
+
+	res, err := expandEnv("test1: ${TEST}\ntest2: ${DUMMY_UNSET:-default}\ntest3: ${EMPTY}", os.LookupEnv)
+	assert.Nil(t, err)
+	assert.Equal(t, "test1: en_US.UTF-8\ntest2: default\ntest3: ", res)
+}
+
+func TestLoadConfigEnvError(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"dbyml.yml": "image:\n  name: ${DBYML_TEST_NAME}\n  tag: ${DBYML_TEST_TAG:?tag is required}\n",
+	})
+
+	// All the problems are returned as the error of LoadConfig, not a panic.
+	_, err := LoadConfig("dbyml.yml", "", nil)
+	assert.EqualError(t, err, `dbyml.yml: 2 errors in environment variables:
+  line 2: ${DBYML_TEST_NAME} not defined
+  line 3: ${DBYML_TEST_TAG}: tag is required`)
+	var envErr *EnvError
+	assert.True(t, errors.As(err, &envErr))
+	assert.Equal(t, 2, len(envErr.Problems))
+}
@@ -0,0 +1,543 @@
+package dbyml
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/stdcopy"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/http2"
+)
+
+// fakeDocker is an in-memory DockerAPI which records the calls, so that the build, push and
+// builder lifecycle are tested without a docker daemon.
+type fakeDocker struct {
+	mu         sync.Mutex
+	calls      []string
+	errs       map[string]error // The error returned by the method of the name
+	images     map[string]bool  // The tags of the images on host
+	pushed     []string
+	contexts   [][]byte // The build contexts sent by ImageBuild
+	containers map[string]*fakeContainer
+	execs      map[string]*fakeExec
+	nextID     int
+
+	// execHandler runs the command in the container, and returns the output and exit code.
+	// The command succeeds with no output if nil.
+	execHandler func(cmd []string) (stdout string, stderr string, code int)
+	// buildOutput is the JSON messages returned by ImageBuild.
+	buildOutput string
+	builds      []types.ImageBuildOptions // The options of ImageBuild
+	pullBody    *fakeBody                 // The response of the last ImagePull
+
+	// buildSecrets are the ids of the secrets read through the session on ImageBuild with the session.
+	buildSecrets []string
+	secrets      map[string]string // The values of the secrets read on ImageBuild
+	sessions     chan net.Conn     // The connections of the sessions dialed by DialHijack
+}
+
+type fakeContainer struct {
+	ID         string
+	Name       string
+	Config     *container.Config
+	HostConfig *container.HostConfig
+	Status     string
+	Files      map[string][]byte // The files copied into the container by the absolute path
+}
+
+type fakeExec struct {
+	Container *fakeContainer
+	Cmd       []string
+	ExitCode  int
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		errs:        map[string]error{},
+		images:      map[string]bool{},
+		containers:  map[string]*fakeContainer{},
+		execs:       map[string]*fakeExec{},
+		secrets:     map[string]string{},
+		sessions:    make(chan net.Conn, 1),
+		buildOutput: `{"stream":"Step 1/1 : FROM scratch\n"}` + "\n",
+	}
+}
+
+// call records the call of the method, and returns the error set for the method.
+func (f *fakeDocker) call(method string) error {
+	f.calls = append(f.calls, method)
+	return f.errs[method]
+}
+
+// Calls returns the names of the methods called in order.
+func (f *fakeDocker) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+func (f *fakeDocker) newID() string {
+	f.nextID++
+	return fmt.Sprintf("%064x", f.nextID)
+}
+
+// find returns the container by ID or name.
+func (f *fakeDocker) find(ref string) (*fakeContainer, error) {
+	if c, ok := f.containers[ref]; ok {
+		return c, nil
+	}
+	for _, c := range f.containers {
+		if c.Name == ref {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("Error: No such container: %s", ref)
+}
+
+func jsonBody(s string) io.ReadCloser {
+	return ioutil.NopCloser(strings.NewReader(s))
+}
+
+// fakeBody is the body of response which records whether it is closed.
+type fakeBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *fakeBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (f *fakeDocker) ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	if options.SessionID != "" {
+		if err := f.readSecrets(ctx); err != nil {
+			return types.ImageBuildResponse{}, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ImageBuild"); err != nil {
+		return types.ImageBuildResponse{}, err
+	}
+	f.builds = append(f.builds, options)
+	if buildContext != nil {
+		b, err := ioutil.ReadAll(buildContext)
+		if err != nil {
+			return types.ImageBuildResponse{}, err
+		}
+		f.contexts = append(f.contexts, b)
+	}
+	for _, tag := range options.Tags {
+		f.images[tag] = true
+	}
+	return types.ImageBuildResponse{Body: jsonBody(f.buildOutput)}, nil
+}
+
+// readSecrets reads the secrets through the session dialed by the client, as buildkit in docker daemon does.
+func (f *fakeDocker) readSecrets(ctx context.Context) error {
+	var conn net.Conn
+	select {
+	case conn = <-f.sessions:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	for _, id := range f.buildSecrets {
+		resp, status, err := callSession(cc, sessionSecretMethod, appendProtoBytes(nil, 1, []byte(id)))
+		if err != nil {
+			return err
+		}
+		if status != "0" {
+			return fmt.Errorf("failed to read secret %v: status %v", id, status)
+		}
+		fields, err := decodeProto(resp)
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
+		f.secrets[id] = string(protoBytes(fields, 1))
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+func (f *fakeDocker) ImageHistory(ctx context.Context, imageID string) ([]image.HistoryResponseItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ImageHistory"); err != nil {
+		return nil, err
+	}
+	return []image.HistoryResponseItem{}, nil
+}
+
+func (f *fakeDocker) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ImageList"); err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for tag := range f.images {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	summaries := []types.ImageSummary{}
+	for _, tag := range tags {
+		summaries = append(summaries, types.ImageSummary{RepoTags: []string{tag}})
+	}
+	return summaries, nil
+}
+
+func (f *fakeDocker) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ImageLoad"); err != nil {
+		return types.ImageLoadResponse{}, err
+	}
+	if _, err := io.Copy(ioutil.Discard, input); err != nil {
+		return types.ImageLoadResponse{}, err
+	}
+	return types.ImageLoadResponse{Body: jsonBody(`{"stream":"Loaded image\n"}` + "\n"), JSON: true}, nil
+}
+
+func (f *fakeDocker) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ImagePull"); err != nil {
+		return nil, err
+	}
+	f.images[ref] = true
+	f.pullBody = &fakeBody{Reader: strings.NewReader(fmt.Sprintf(`{"status":"Downloaded newer image for %s"}`+"\n", ref))}
+	return f.pullBody, nil
+}
+
+func (f *fakeDocker) ImagePush(ctx context.Context, ref string, options types.ImagePushOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ImagePush"); err != nil {
+		return nil, err
+	}
+	if !f.images[ref] {
+		return nil, fmt.Errorf("An image does not exist locally with the tag: %s", ref)
+	}
+	f.pushed = append(f.pushed, ref)
+	return jsonBody(fmt.Sprintf(`{"status":"Pushed %s"}`+"\n", ref)), nil
+}
+
+func (f *fakeDocker) ImageTag(ctx context.Context, source, target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ImageTag"); err != nil {
+		return err
+	}
+	if !f.images[source] {
+		return fmt.Errorf("Error response from daemon: No such image: %s", source)
+	}
+	f.images[target] = true
+	return nil
+}
+
+func (f *fakeDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ContainerCreate"); err != nil {
+		return container.ContainerCreateCreatedBody{}, err
+	}
+	if _, err := f.find(containerName); err == nil {
+		return container.ContainerCreateCreatedBody{}, fmt.Errorf("Conflict. The container name %q is already in use", "/"+containerName)
+	}
+	c := &fakeContainer{
+		ID:         f.newID(),
+		Name:       containerName,
+		Config:     config,
+		HostConfig: hostConfig,
+		Status:     "created",
+		Files:      map[string][]byte{},
+	}
+	f.containers[c.ID] = c
+	return container.ContainerCreateCreatedBody{ID: c.ID}, nil
+}
+
+func (f *fakeDocker) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ContainerInspect"); err != nil {
+		return types.ContainerJSON{}, err
+	}
+	c, err := f.find(containerID)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	mounts := []types.MountPoint{}
+	for _, m := range c.HostConfig.Mounts {
+		mounts = append(mounts, types.MountPoint{Type: m.Type, Source: m.Source, Destination: m.Target})
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         c.ID,
+			Name:       "/" + c.Name,
+			State:      &types.ContainerState{Status: c.Status, Running: c.Status == "running"},
+			HostConfig: c.HostConfig,
+		},
+		Mounts: mounts,
+		Config: c.Config,
+	}, nil
+}
+
+func (f *fakeDocker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ContainerList"); err != nil {
+		return nil, err
+	}
+	list := []types.Container{}
+	for _, c := range f.containers {
+		if options.All || c.Status == "running" {
+			list = append(list, types.Container{ID: c.ID, Names: []string{"/" + c.Name}, State: c.Status})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (f *fakeDocker) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ContainerRemove"); err != nil {
+		return err
+	}
+	c, err := f.find(containerID)
+	if err != nil {
+		return err
+	}
+	if c.Status == "running" && !options.Force {
+		return fmt.Errorf("You cannot remove a running container %s", c.ID)
+	}
+	delete(f.containers, c.ID)
+	return nil
+}
+
+func (f *fakeDocker) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ContainerStart"); err != nil {
+		return err
+	}
+	c, err := f.find(containerID)
+	if err != nil {
+		return err
+	}
+	c.Status = "running"
+	return nil
+}
+
+func (f *fakeDocker) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ContainerStop"); err != nil {
+		return err
+	}
+	c, err := f.find(containerID)
+	if err != nil {
+		return err
+	}
+	if c.Status == "running" {
+		c.Status = "exited"
+	}
+	return nil
+}
+
+// CopyFromContainer returns the tar archive of the files under srcPath, whose names begin with the base of srcPath.
+func (f *fakeDocker) CopyFromContainer(ctx context.Context, containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var stat types.ContainerPathStat
+	if err := f.call("CopyFromContainer"); err != nil {
+		return nil, stat, err
+	}
+	c, err := f.find(containerID)
+	if err != nil {
+		return nil, stat, err
+	}
+	names := []string{}
+	for name := range c.Files {
+		if strings.HasPrefix(name, srcPath+"/") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, stat, fmt.Errorf("Could not find the file %s in container %s", srcPath, c.Name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:     path.Base(srcPath) + strings.TrimPrefix(name, srcPath),
+			Mode:     0o644,
+			Size:     int64(len(c.Files[name])),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, stat, err
+		}
+		if _, err := tw.Write(c.Files[name]); err != nil {
+			return nil, stat, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, stat, err
+	}
+	stat = types.ContainerPathStat{Name: path.Base(srcPath), Mode: 0o755 | 1<<31}
+	return ioutil.NopCloser(&buf), stat, nil
+}
+
+// CopyToContainer extracts the regular files in the tar archive, which may be compressed, into dstPath.
+func (f *fakeDocker) CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CopyToContainer"); err != nil {
+		return err
+	}
+	c, err := f.find(containerID)
+	if err != nil {
+		return err
+	}
+	r, err := decompressTar(content)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		c.Files[path.Join(dstPath, hdr.Name)] = b
+	}
+}
+
+// decompressTar returns the reader of the tar archive, which is decompressed if gzipped.
+func decompressTar(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+func (f *fakeDocker) ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ContainerExecCreate"); err != nil {
+		return types.IDResponse{}, err
+	}
+	c, err := f.find(container)
+	if err != nil {
+		return types.IDResponse{}, err
+	}
+	if c.Status != "running" {
+		return types.IDResponse{}, fmt.Errorf("Container %s is not running", c.ID)
+	}
+	id := f.newID()
+	f.execs[id] = &fakeExec{Container: c, Cmd: config.Cmd}
+	return types.IDResponse{ID: id}, nil
+}
+
+// ContainerExecAttach runs the command by execHandler, and returns the connection streaming the output.
+// The commands to make and remove directories are applied to the files in the container.
+func (f *fakeDocker) ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ContainerExecAttach"); err != nil {
+		return types.HijackedResponse{}, err
+	}
+	exec, ok := f.execs[execID]
+	if !ok {
+		return types.HijackedResponse{}, fmt.Errorf("No such exec instance: %s", execID)
+	}
+	if len(exec.Cmd) > 2 && exec.Cmd[0] == "rm" {
+		for _, dir := range exec.Cmd[2:] {
+			for name := range exec.Container.Files {
+				if name == dir || strings.HasPrefix(name, dir+"/") {
+					delete(exec.Container.Files, name)
+				}
+			}
+		}
+	}
+	stdout, stderr, code := "", "", 0
+	if f.execHandler != nil {
+		stdout, stderr, code = f.execHandler(exec.Cmd)
+	}
+	exec.ExitCode = code
+
+	server, conn := net.Pipe()
+	go func() {
+		defer server.Close()
+		if config.Tty {
+			io.WriteString(server, stdout+stderr)
+			return
+		}
+		io.WriteString(stdcopy.NewStdWriter(server, stdcopy.Stdout), stdout)
+		io.WriteString(stdcopy.NewStdWriter(server, stdcopy.Stderr), stderr)
+	}()
+	return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(conn)}, nil
+}
+
+func (f *fakeDocker) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ContainerExecInspect"); err != nil {
+		return types.ContainerExecInspect{}, err
+	}
+	exec, ok := f.execs[execID]
+	if !ok {
+		return types.ContainerExecInspect{}, fmt.Errorf("No such exec instance: %s", execID)
+	}
+	return types.ContainerExecInspect{ExecID: execID, ContainerID: exec.Container.ID, ExitCode: exec.ExitCode}, nil
+}
+
+func (f *fakeDocker) DialHijack(ctx context.Context, url, proto string, meta map[string][]string) (net.Conn, error) {
+	f.mu.Lock()
+	err := f.call("DialHijack")
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	client, server := net.Pipe()
+	f.sessions <- server
+	return client, nil
+}
@@ -4,31 +4,40 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"reflect"
+	"strings"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/jsonmessage"
-	"github.com/moby/term"
 )
 
 // ImageInfo defines docker image information.
 type ImageInfo struct {
-	Basename   string             `yaml:"name"`        // Image name
-	Tag        string             `yaml:"tag"`         // Image tag
-	ImageName  string             `yaml:"image_name"`  // Image name such as `go-dbyml:latest`
-	Context    string             `yaml:"path"`        // Path to the directory where Dockerfile exists, is equivalent to build context
-	Dockerfile string             `yaml:"dockerfile"`  // Dockerfile filename
-	BuildArgs  map[string]*string `yaml:"build_args"`  // Build-args to be passed to image on build
-	Labels     map[string]string  `yaml:"label"`       // Labels to be passed to image on build
-	DockerHost string             `yaml:"docker_host"` // Docker host such as "unix:///var/run/docker.sock"
+	Basename   string                  `yaml:"name"`        // Image name
+	Tag        string                  `yaml:"tag"`         // Image tag
+	ImageName  string                  `yaml:"image_name"`  // Image name such as `go-dbyml:latest`
+	Context    string                  `yaml:"path"`        // Path to the build context directory, or URL to a Git repository or a tarball
+	Dockerfile string                  `yaml:"dockerfile"`  // Path to Dockerfile in the context or any other path, or `-` to read from stdin
+	BuildArgs  map[string]*SecretValue `yaml:"build_args"`  // Build-args to be passed to image on build
+	Labels     map[string]string       `yaml:"label"`       // Labels to be passed to image on build
+	DockerHost string                  `yaml:"docker_host"` // Docker host such as "unix:///var/run/docker.sock"
+	TLSVerify  bool                    `yaml:"tls_verify"`  // Use TLS and verify the certificate of the docker host
+	CertPath   string                  `yaml:"cert_path"`   // Directory containing ca.pem, cert.pem and key.pem for TLS
+
+	DockerfileInline string            `yaml:"dockerfile_inline"` // Content of Dockerfile used instead of dockerfile
+	Contexts         map[string]string `yaml:"contexts"`          // Named additional build contexts for buildkit
+	Secrets          []SecretSpec      `yaml:"secrets"`           // Build secrets mounted by RUN --mount=type=secret
+	SSH              []SSHSpec         `yaml:"ssh"`               // SSH agent sockets or keys forwarded to buildkit
 
 	DockerfilePath string
 	Registry       RegistryInfo
 	BuildInfo      BuildInfo
 	FullName       string
-	DockerClient   *client.Client
+	DockerClient   DockerAPI
+	Progress       *Progress
 }
 
 // NewImageInfo creates a new ImageInfo struct with default values.
@@ -37,26 +46,86 @@ func NewImageInfo() *ImageInfo {
 	image.Tag = "latest"
 	image.Context = "."
 	image.Dockerfile = "Dockerfile"
-	image.DockerHost = "unix:///var/run/docker.sock"
 	image.DockerfilePath = image.Context + "/" + image.Dockerfile
 	image.Registry = *NewRegistryInfo()
 	image.BuildInfo = *NewBuildInfo()
 	return image
 }
 
+// The name of a Dockerfile outside the build context, which is injected into the context on build.
+const externalDockerfileName = ".dbyml.Dockerfile"
+
 // SetProperties sets some properties when build an image.
 func (image *ImageInfo) SetProperties() {
 	image.ImageName = image.Basename + ":" + image.Tag
-	image.DockerfilePath = image.Context + "/" + image.Dockerfile
-	image.SetDockerClient()
+	image.SetDockerfilePath()
+	image.Progress, _ = NewProgress(ProgressAuto)
+}
+
+// SetDockerfilePath sets the path to Dockerfile.
+// The dockerfile is looked up in the build context first, then relative to the current directory.
+// For the remote build context, the dockerfile is always the path in the remote context.
+// DockerfilePath is empty if the Dockerfile is given by stdin or dockerfile_inline.
+func (image *ImageInfo) SetDockerfilePath() {
+	inContext := image.Context + "/" + image.Dockerfile
+	switch {
+	case image.DockerfileInline != "" || image.Dockerfile == "-":
+		image.DockerfilePath = ""
+	case IsRemoteContext(image.Context):
+		image.DockerfilePath = image.Dockerfile
+	case fileExists(inContext) || !fileExists(image.Dockerfile):
+		image.DockerfilePath = inContext
+	default:
+		image.DockerfilePath = image.Dockerfile
+	}
+}
+
+// IsDockerfileInContext returns true if the Dockerfile is included in the build context.
+// The Dockerfile looked up from the build context but out of it such as ../Dockerfile is not included.
+func (image *ImageInfo) IsDockerfileInContext() bool {
+	if IsRemoteContext(image.Context) {
+		return image.DockerfilePath != ""
+	}
+	if _, err := joinInside(image.Context, image.Dockerfile); err != nil {
+		return false
+	}
+	return image.DockerfilePath == image.Context+"/"+image.Dockerfile
 }
 
-// SetDockerClient initializes docker api client for the specified host.
-func (image *ImageInfo) SetDockerClient() {
-	image.DockerClient, _ = client.NewClientWithOpts(
-		client.WithHost(image.DockerHost),
-		client.WithAPIVersionNegotiation(),
-	)
+// ExternalDockerfile returns the content of the Dockerfile if it is outside the build context,
+// otherwise returns nil. The Dockerfile given by stdin is read only once.
+func (image *ImageInfo) ExternalDockerfile() ([]byte, error) {
+	if image.DockerfileInline != "" {
+		return []byte(image.DockerfileInline), nil
+	}
+	if image.Dockerfile == "-" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		image.DockerfileInline = string(b)
+		return b, nil
+	}
+	if image.IsDockerfileInContext() {
+		return nil, nil
+	}
+	return ioutil.ReadFile(image.DockerfilePath)
+}
+
+// SetDockerClient initializes docker api client for the docker host resolved by ResolveDockerEndpoint.
+// DockerHost is set to the resolved host.
+func (image *ImageInfo) SetDockerClient() error {
+	endpoint, err := ResolveDockerEndpoint(image.DockerHost, image.TLSVerify, image.CertPath)
+	if err != nil {
+		return err
+	}
+	cli, err := NewDockerClient(endpoint)
+	if err != nil {
+		return err
+	}
+	image.DockerHost = endpoint.Host
+	image.DockerClient = cli
+	return nil
 }
 
 // ShowProperties shows the current settings related to image build.
@@ -67,7 +136,28 @@ func (image ImageInfo) ShowProperties() {
 		field := rt.Field(i)
 		kind := field.Type.Kind()
 		value := rv.FieldByName(field.Name)
-		if kind == reflect.Map || kind == reflect.Slice {
+		if field.Name == "DockerfileInline" {
+			if value.Len() > 0 {
+				fmt.Printf("%-30v: (%v bytes)\n", field.Name, value.Len())
+			}
+		} else if field.Name == "Secrets" {
+			// Show only where the secrets are read from, never the values.
+			for j, secret := range image.Secrets {
+				name := ""
+				if j == 0 {
+					name = field.Name
+				}
+				fmt.Printf("%-30v: %v: %v\n", name, secret.ID, secret.Source())
+			}
+		} else if field.Name == "SSH" {
+			for j, spec := range image.SSH {
+				name := ""
+				if j == 0 {
+					name = field.Name
+				}
+				fmt.Printf("%-30v: %v\n", name, spec)
+			}
+		} else if kind == reflect.Map || kind == reflect.Slice {
 			showMapElement(field.Name, value.MapRange())
 		} else if kind == reflect.String && value.Interface() != "" {
 			fmt.Printf("%-30v: %v\n", field.Name, value)
@@ -76,30 +166,127 @@ func (image ImageInfo) ShowProperties() {
 }
 
 // Build runs image build.
-func (image *ImageInfo) Build() error {
-	buf := GetBuildContext(image.Context)
-	tar := bytes.NewReader(buf.Bytes())
-	ctx := context.Background()
+func (image *ImageInfo) Build(ctx context.Context) error {
+	options, err := image.BuildOptions()
+	if err != nil {
+		return err
+	}
+
+	if len(image.Contexts) != 0 {
+		return fmt.Errorf("named build contexts are supported only on build with buildkit")
+	}
+	if len(image.SSH) != 0 {
+		return fmt.Errorf("ssh forwarding is supported only on build with buildkit")
+	}
 
-	options := types.ImageBuildOptions{
+	var buildContext io.Reader
+	if IsRemoteContext(image.Context) {
+		if image.DockerfilePath == "" {
+			return fmt.Errorf("dockerfile_inline and stdin cannot be used with the remote build context %v", image.Context)
+		}
+		options.RemoteContext = image.Context
+	} else {
+		tar, dockerfile, err := image.localContext()
+		if err != nil {
+			return err
+		}
+		buildContext = tar
+		options.Dockerfile = dockerfile
+	}
+
+	if len(image.Secrets) != 0 {
+		fmt.Println("Build secrets are set, so the image is built with buildkit in docker daemon instead of the classic builder.")
+		closeSession, err := startSecretSession(ctx, image.dialSession, image.Secrets, &options)
+		if err != nil {
+			return err
+		}
+		defer closeSession()
+	}
+
+	res, err := image.DockerClient.ImageBuild(ctx, buildContext, options)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := image.Progress.DisplayJSONMessages(res.Body); err != nil {
+		return err
+	}
+
+	// The size of layer made by each step is shown in the summary.
+	if image.Progress.Summary {
+		if history, err := image.DockerClient.ImageHistory(ctx, image.ImageName); err == nil {
+			image.Progress.SetLayerSizes(history)
+		}
+	}
+	return nil
+}
+
+// dialSession hijacks the connection of the session from docker daemon.
+func (image *ImageInfo) dialSession(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+	return image.DockerClient.DialHijack(ctx, "/session", proto, meta)
+}
+
+// BuildOptions returns the options on image build passed to docker daemon.
+func (image *ImageInfo) BuildOptions() (types.ImageBuildOptions, error) {
+	args, err := image.BuildArgValues()
+	if err != nil {
+		return types.ImageBuildOptions{}, err
+	}
+	return types.ImageBuildOptions{
 		NoCache:    image.BuildInfo.NoCache,
 		Dockerfile: image.DockerfilePath,
 		Remove:     true,
-		BuildArgs:  image.BuildArgs,
+		BuildArgs:  args,
 		Labels:     image.Labels,
 		Target:     image.BuildInfo.Target,
 		Tags:       []string{image.ImageName},
+		CacheFrom:  image.BuildInfo.CacheFrom,
+	}, nil
+}
+
+// BuildArgValues returns the values of build args, reading the secret references.
+// The build arg without value is nil, which is taken from the environment variable by docker.
+func (image *ImageInfo) BuildArgValues() (map[string]*string, error) {
+	if image.BuildArgs == nil {
+		return nil, nil
+	}
+	args := map[string]*string{}
+	for k, v := range image.BuildArgs {
+		if v == nil {
+			args[k] = nil
+			continue
+		}
+		value, err := v.Value()
+		if err != nil {
+			return nil, fmt.Errorf("build arg %v: %v", k, err)
+		}
+		args[k] = &value
 	}
+	return args, nil
+}
 
-	res, err := image.DockerClient.ImageBuild(ctx, tar, options)
+// localContext makes the tar archive of the build context in local directory,
+// and returns it with the path to Dockerfile in the archive.
+func (image *ImageInfo) localContext() (io.Reader, string, error) {
+	if err := image.BuildInfo.CheckContext(image.Context); err != nil {
+		return nil, "", err
+	}
+	buf := GetBuildContext(image.Context)
+	dockerfile := image.DockerfilePath
+	content, err := image.ExternalDockerfile()
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-	defer res.Body.Close()
-
-	termFd, isTerm := term.GetFdInfo(os.Stderr)
-	err = jsonmessage.DisplayJSONMessagesStream(res.Body, os.Stderr, termFd, isTerm, nil)
-	return err
+	if content != nil {
+		dockerfile = externalDockerfileName
+		if buf, err = AppendToContext(buf, dockerfile, content); err != nil {
+			return nil, "", err
+		}
+	}
+	if buf, err = image.BuildInfo.PrepareContext(image.Context, buf); err != nil {
+		return nil, "", err
+	}
+	return bytes.NewReader(buf.Bytes()), dockerfile, nil
 }
 
 // SetFullImageName sets image name for pushing to a registry.
@@ -112,30 +299,33 @@ func (image *ImageInfo) SetFullImageName() {
 }
 
 // Push runs image push to a registry.
-func (image *ImageInfo) Push() error {
-	ctx := context.Background()
-	image.AddTag()
+func (image *ImageInfo) Push(ctx context.Context) error {
+	if err := image.AddTag(ctx); err != nil {
+		return err
+	}
 
-	opts := types.ImagePushOptions{All: false, RegistryAuth: image.Registry.BasicAuth()}
+	auth, err := image.Registry.BasicAuth()
+	if err != nil {
+		return err
+	}
+	opts := types.ImagePushOptions{All: false, RegistryAuth: auth}
 
 	res, err := image.DockerClient.ImagePush(ctx, image.FullName, opts)
 	if err != nil {
 		return err
 	}
 	defer res.Close()
-
-	termFd, isTerm := term.GetFdInfo(os.Stderr)
-	err = jsonmessage.DisplayJSONMessagesStream(res, os.Stderr, termFd, isTerm, nil)
-	return err
+	return image.Progress.DisplayJSONMessages(res)
 }
 
 // AddTag adds a tag containing the registry name to a built image.
-func (image *ImageInfo) AddTag() {
-	ctx := context.Background()
+func (image *ImageInfo) AddTag(ctx context.Context) error {
 	image.SetFullImageName()
+	return image.DockerClient.ImageTag(ctx, image.ImageName, image.FullName)
+}
 
-	err := image.DockerClient.ImageTag(ctx, image.ImageName, image.FullName)
-	if err != nil {
-		panic(err)
-	}
+// IsLocalContext returns true if the named build context is a directory on host.
+// Otherwise the context is a reference such as `docker-image://alpine:3.16` or a URL passed to buildkit as is.
+func IsLocalContext(value string) bool {
+	return !strings.Contains(value, "://") && !IsGitURL(value)
 }
@@ -0,0 +1,78 @@
+package dbyml
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetDockerfilePath(t *testing.T) {
+	pwd, _ := os.Getwd()
+	root, _ := filepath.Abs("../")
+	os.Chdir(root)
+	defer os.Chdir(pwd)
+
+	// Dockerfile in the build context
+	image := NewImageInfo()
+	image.Context = "testdata/dockerfile_standard"
+	image.SetDockerfilePath()
+	assert.Equal(t, "testdata/dockerfile_standard/Dockerfile", image.DockerfilePath)
+	assert.True(t, image.IsDockerfileInContext())
+	content, err := image.ExternalDockerfile()
+	assert.Nil(t, err)
+	assert.Nil(t, content)
+
+	// Dockerfile outside the build context
+	image.Dockerfile = "testdata/dockerfile_multistage/multi-Dockerfile"
+	image.SetDockerfilePath()
+	assert.Equal(t, "testdata/dockerfile_multistage/multi-Dockerfile", image.DockerfilePath)
+	assert.False(t, image.IsDockerfileInContext())
+	content, err = image.ExternalDockerfile()
+	assert.Nil(t, err)
+	expected, _ := ioutil.ReadFile("testdata/dockerfile_multistage/multi-Dockerfile")
+	assert.Equal(t, expected, content)
+
+	// Dockerfile looked up from the build context but out of it is injected as the external one
+	image.Dockerfile = "../dockerfile_multistage/multi-Dockerfile"
+	image.SetDockerfilePath()
+	assert.Equal(t, "testdata/dockerfile_standard/../dockerfile_multistage/multi-Dockerfile", image.DockerfilePath)
+	assert.False(t, image.IsDockerfileInContext())
+	content, err = image.ExternalDockerfile()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, content)
+
+	// Inline Dockerfile
+	image.DockerfileInline = "FROM alpine:latest\n"
+	image.SetDockerfilePath()
+	assert.Equal(t, "", image.DockerfilePath)
+	content, err = image.ExternalDockerfile()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("FROM alpine:latest\n"), content)
+}
+
+func TestAppendToContext(t *testing.T) {
+	dir := makeContext(t, map[string]int{"Dockerfile": 10, "main.go": 20})
+	buf, err := AppendToContext(GetBuildkitContext(dir), externalDockerfileName, []byte("FROM scratch\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := readTar(t, buf)
+	assert.Equal(t, 3, len(files))
+	assert.Equal(t, "FROM scratch\n", files[externalDockerfileName])
+}
+
+func TestBuildOptions(t *testing.T) {
+	image := NewImageInfo()
+	image.Basename = "test"
+	image.SetProperties()
+	image.BuildInfo.CacheFrom = []string{"reg/test:branch", "reg/test:main"}
+
+	options, err := image.BuildOptions()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test:latest"}, options.Tags)
+	assert.Equal(t, []string{"reg/test:branch", "reg/test:main"}, options.CacheFrom)
+}
@@ -0,0 +1,257 @@
+package dbyml
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The format of {{.Date}} in the name of log file
+const logDateFormat = "20060102-150405"
+
+// The glob pattern matching the dates in logDateFormat
+var logDatePattern = regexp.MustCompile(`[0-9]`).ReplaceAllString(logDateFormat, "[0-9]")
+
+// logNameFields are the fields available in the template of log_file.
+type logNameFields struct {
+	Image string // Image name, where `/` is replaced with `_`
+	Tag   string // Image tag
+	Date  string // Date and time when the build starts, such as 20220601-123045
+}
+
+// BuildLog is a log file into which the output on console is copied without colors.
+type BuildLog struct {
+	Path string
+
+	file   *os.File
+	writer *ansiStripper
+}
+
+// LogFilePath renders the template of log file such as `build-{{.Image}}-{{.Date}}.log`.
+func LogFilePath(tmpl string, image *ImageInfo, date time.Time) (string, error) {
+	return renderLogName(tmpl, logNameFields{
+		Image: strings.ReplaceAll(image.Basename, "/", "_"),
+		Tag:   image.Tag,
+		Date:  date.Format(logDateFormat),
+	})
+}
+
+func renderLogName(tmpl string, fields logNameFields) (string, error) {
+	t, err := template.New("log_file").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid log_file %q: %v", tmpl, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, fields); err != nil {
+		return "", fmt.Errorf("invalid log_file %q: %v", tmpl, err)
+	}
+	return buf.String(), nil
+}
+
+// OpenBuildLog creates the log file for the build, and removes the old log files of the same image
+// so that at most keep files remain. The old log files are not removed if keep is zero or less.
+func OpenBuildLog(tmpl string, image *ImageInfo, keep int) (*BuildLog, error) {
+	path, err := LogFilePath(tmpl, image, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	if keep > 0 {
+		if err := rotateLogs(tmpl, image, keep-1); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &BuildLog{Path: path, file: file, writer: &ansiStripper{out: file}}, nil
+}
+
+// rotateLogs removes the oldest log files of the image so that at most keep files remain.
+// The log files of the image are those matching the template with any date in logDateFormat,
+// so that the log files of another image whose name starts with the same name are not removed.
+func rotateLogs(tmpl string, image *ImageInfo, keep int) error {
+	pattern, err := renderLogName(tmpl, logNameFields{
+		Image: strings.ReplaceAll(image.Basename, "/", "_"),
+		Tag:   image.Tag,
+		Date:  logDatePattern,
+	})
+	if err != nil {
+		return err
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(files) <= keep {
+		return nil
+	}
+	modTimes := map[string]time.Time{}
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			modTimes[f] = info.ModTime()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if modTimes[files[i]].Equal(modTimes[files[j]]) {
+			return files[i] > files[j]
+		}
+		return modTimes[files[i]].After(modTimes[files[j]])
+	})
+	for _, f := range files[keep:] {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tee copies the output written to stdout and stderr into the log file until the returned function is called.
+// The function waits until all the output is written, and closes the log file.
+func (log *BuildLog) Tee() func() {
+	if log == nil {
+		return func() {}
+	}
+	orgStdout, orgStderr := os.Stdout, os.Stderr
+	var wg sync.WaitGroup
+	tee := func(dst *os.File) *os.File {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return dst
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(io.MultiWriter(dst, log.writer), r)
+			r.Close()
+		}()
+		return w
+	}
+	os.Stdout = tee(orgStdout)
+	os.Stderr = tee(orgStderr)
+
+	return func() {
+		if os.Stdout != orgStdout {
+			os.Stdout.Close()
+		}
+		if os.Stderr != orgStderr {
+			os.Stderr.Close()
+		}
+		wg.Wait()
+		os.Stdout, os.Stderr = orgStdout, orgStderr
+		log.writer.Flush()
+		log.file.Close()
+	}
+}
+
+// Capture writes the output of fnc only into the log file, such as the settings not shown on console.
+// The output is written without colors and with the secrets redacted as the output copied by Tee.
+func (log *BuildLog) Capture(fnc func()) {
+	if log == nil {
+		return
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(log.writer, r)
+		r.Close()
+		close(done)
+	}()
+	org := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = org
+		w.Close()
+		<-done
+	}()
+	fnc()
+}
+
+// ansiStripper removes the ANSI escape sequences such as colors and cursor movements from the output,
+// and redacts the secrets. The sequences split across writes are handled by keeping the state between writes,
+// and the text is written by line so that the secret split across writes is redacted.
+type ansiStripper struct {
+	out   io.Writer
+	mu    sync.Mutex
+	state int
+	line  []byte // The text after the last end of line, which is not written yet
+}
+
+const (
+	ansiText = iota
+	ansiEscape
+	ansiCSI
+	ansiOSC
+)
+
+func (s *ansiStripper) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf := make([]byte, 0, len(p))
+	for _, c := range p {
+		switch s.state {
+		case ansiText:
+			if c == 0x1b {
+				s.state = ansiEscape
+			} else {
+				buf = append(buf, c)
+			}
+		case ansiEscape:
+			switch c {
+			case '[':
+				s.state = ansiCSI
+			case ']':
+				s.state = ansiOSC
+			default:
+				s.state = ansiText
+			}
+		case ansiCSI:
+			if c >= 0x40 && c <= 0x7e {
+				s.state = ansiText
+			}
+		case ansiOSC:
+			if c == 0x07 {
+				s.state = ansiText
+			} else if c == 0x1b {
+				s.state = ansiEscape
+			}
+		}
+	}
+	s.line = append(s.line, buf...)
+	if i := bytes.LastIndexAny(s.line, "\r\n"); i >= 0 {
+		lines := s.line[:i+1]
+		s.line = append([]byte(nil), s.line[i+1:]...)
+		if _, err := s.out.Write([]byte(Redact(string(lines)))); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes the text not ended with the end of line.
+func (s *ansiStripper) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.line) == 0 {
+		return nil
+	}
+	_, err := s.out.Write([]byte(Redact(string(s.line))))
+	s.line = nil
+	return err
+}
@@ -0,0 +1,102 @@
+package dbyml
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFilePath(t *testing.T) {
+	image := &ImageInfo{Basename: "project/app", Tag: "v1"}
+	date := time.Date(2022, 6, 1, 12, 30, 45, 0, time.UTC)
+
+	path, err := LogFilePath("logs/build-{{.Image}}-{{.Tag}}-{{.Date}}.log", image, date)
+	assert.Nil(t, err)
+	assert.Equal(t, "logs/build-project_app-v1-20220601-123045.log", path)
+
+	_, err = LogFilePath("build-{{.Unknown}}.log", image, date)
+	assert.Error(t, err)
+	_, err = LogFilePath("build-{{.Image}.log", image, date)
+	assert.Error(t, err)
+}
+
+func TestRotateLogs(t *testing.T) {
+	dir := t.TempDir()
+	image := &ImageInfo{Basename: "app", Tag: "latest"}
+	tmpl := filepath.Join(dir, "build-{{.Image}}-{{.Date}}.log")
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("build-app-2022060%d-000000.log", i+1))
+		ioutil.WriteFile(path, []byte("old"), 0o644)
+		mtime := now.Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(path, mtime, mtime)
+	}
+	other := filepath.Join(dir, "build-other-20220601-000000.log")
+	ioutil.WriteFile(other, []byte("other"), 0o644)
+	// The log files of the images whose names start with "app-" are not those of "app".
+	worker := filepath.Join(dir, "build-app-worker-20220601-000000.log")
+	ioutil.WriteFile(worker, []byte("worker"), 0o644)
+	numbered := filepath.Join(dir, "build-app-1-worker-20220601-000000.log")
+	ioutil.WriteFile(numbered, []byte("worker"), 0o644)
+	for _, path := range []string{worker, numbered} {
+		mtime := now.Add(-time.Hour)
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	log, err := OpenBuildLog(tmpl, image, 3)
+	assert.Nil(t, err)
+	log.file.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "build-app-2*.log"))
+	assert.Equal(t, 3, len(files))
+	assert.Contains(t, files, log.Path)
+	assert.Contains(t, files, filepath.Join(dir, "build-app-20220605-000000.log"))
+	assert.Contains(t, files, filepath.Join(dir, "build-app-20220604-000000.log"))
+	assert.FileExists(t, other)
+	assert.FileExists(t, worker)
+	assert.FileExists(t, numbered)
+}
+
+func TestBuildLogTee(t *testing.T) {
+	dir := t.TempDir()
+	image := &ImageInfo{Basename: "app", Tag: "latest"}
+	addRedaction("capture-secret-4b7e")
+	log, err := OpenBuildLog(filepath.Join(dir, "build.log"), image, 0)
+	assert.Nil(t, err)
+
+	stdout := extractStdout(t, func() {
+		closeLog := log.Tee()
+		fmt.Println("\x1b[31mBuild Failed\x1b[0m")
+		fmt.Fprintln(os.Stderr, "\x1b[1A\x1b[2Kstep 1")
+		// The output only in log is also written without colors and secrets.
+		log.Capture(func() { fmt.Println("\x1b[1monly in log\x1b[0m with capture-secret-4b7e") })
+		closeLog()
+	})
+	assert.Equal(t, "\x1b[31mBuild Failed\x1b[0m", stdout)
+
+	b, err := ioutil.ReadFile(log.Path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), "Build Failed\n")
+	assert.Contains(t, string(b), "step 1\n")
+	assert.Contains(t, string(b), "only in log with *********\n")
+	assert.NotContains(t, string(b), "\x1b")
+	assert.NotContains(t, string(b), "capture-secret-4b7e")
+}
+
+func TestANSIStripper(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "out.log")
+	f, _ := os.Create(log)
+	s := &ansiStripper{out: f}
+	// The escape sequences split across writes are removed.
+	s.Write([]byte("a\x1b[3"))
+	s.Write([]byte("1mb\x1b"))
+	s.Write([]byte("[0mc\x1b]0;title\x07d\n"))
+	f.Close()
+	b, _ := ioutil.ReadFile(log)
+	assert.Equal(t, "abcd\n", string(b))
+}
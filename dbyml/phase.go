@@ -0,0 +1,67 @@
+package dbyml
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PhaseTimeouts holds the timeout of each phase, which is zero for no timeout.
+type PhaseTimeouts struct {
+	Build   time.Duration
+	Push    time.Duration
+	Startup time.Duration
+}
+
+// Timeouts returns the timeouts of the build, push and startup of buildkit builder in config.
+func (config *Configuration) Timeouts() (timeouts PhaseTimeouts, err error) {
+	if timeouts.Build, err = config.BuildInfo.TimeoutDuration(); err != nil {
+		return timeouts, err
+	}
+	if timeouts.Push, err = config.PushInfo.TimeoutDuration(); err != nil {
+		return timeouts, err
+	}
+	timeouts.Startup, err = config.BuildkitInfo.StartupTimeoutDuration()
+	return timeouts, err
+}
+
+// PhaseTimeoutError is the error when a phase such as build or push does not finish within the timeout.
+type PhaseTimeoutError struct {
+	Phase   string
+	Timeout time.Duration
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	return fmt.Sprintf("phase %s timed out after %v", e.Phase, e.Timeout)
+}
+
+// runPhase runs fnc with the context which expires after the timeout of the phase.
+// The phase has no deadline if the timeout is zero.
+func runPhase(ctx context.Context, phase string, timeout time.Duration, fnc func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return fnc(ctx)
+	}
+	phaseCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fnc(phaseCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(phaseCtx.Err(), context.DeadlineExceeded) {
+		return &PhaseTimeoutError{Phase: phase, Timeout: timeout}
+	}
+	return err
+}
+
+// parseTimeout parses the timeout such as `30m`. It returns zero for no timeout if the value is empty.
+func parseTimeout(name string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must not be negative", name, value)
+	}
+	return d, nil
+}
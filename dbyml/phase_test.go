@@ -0,0 +1,71 @@
+package dbyml
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+// waitDone blocks until ctx is done like a hung push or exec.
+func waitDone(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRunPhase(t *testing.T) {
+	err := runPhase(context.Background(), "push", 10*time.Millisecond, waitDone)
+	assert.Equal(t, "phase push timed out after 10ms", err.Error())
+	var timeoutErr *PhaseTimeoutError
+	assert.True(t, errors.As(err, &timeoutErr))
+	assert.Equal(t, "push", timeoutErr.Phase)
+
+	// No deadline without the timeout.
+	err = runPhase(context.Background(), "build", 0, func(ctx context.Context) error {
+		_, ok := ctx.Deadline()
+		assert.False(t, ok)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	// The error of the phase is returned as is.
+	failed := errors.New("failed")
+	err = runPhase(context.Background(), "build", time.Minute, func(ctx context.Context) error { return failed })
+	assert.Equal(t, failed, err)
+
+	// Cancelling the build is not reported as timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = runPhase(ctx, "build", time.Minute, waitDone)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTimeouts(t *testing.T) {
+	config := NewConfiguration()
+	timeouts, err := config.Timeouts()
+	assert.Nil(t, err)
+	assert.Equal(t, PhaseTimeouts{Startup: 2 * time.Minute}, timeouts)
+
+	data := `
+build:
+  timeout: 30m
+push:
+  timeout: 10m
+buildkit:
+  startup_timeout: 45s
+`
+	assert.Nil(t, yaml.Unmarshal([]byte(data), config))
+	timeouts, err = config.Timeouts()
+	assert.Nil(t, err)
+	assert.Equal(t, PhaseTimeouts{Build: 30 * time.Minute, Push: 10 * time.Minute, Startup: 45 * time.Second}, timeouts)
+
+	config.PushInfo.Timeout = "ten minutes"
+	_, err = config.Timeouts()
+	assert.Error(t, err)
+	config.PushInfo.Timeout = "-1m"
+	_, err = config.Timeouts()
+	assert.Error(t, err)
+}
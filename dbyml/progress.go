@@ -0,0 +1,449 @@
+package dbyml
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/moby/term"
+)
+
+// The modes of progress output
+const (
+	ProgressAuto  = "auto"
+	ProgressTTY   = "tty"
+	ProgressPlain = "plain"
+	ProgressJSON  = "json"
+	ProgressQuiet = "quiet"
+)
+
+// ProgressModes is the list of progress modes accepted by --progress and build.progress.
+var ProgressModes = []string{ProgressAuto, ProgressTTY, ProgressPlain, ProgressJSON, ProgressQuiet}
+
+// The types of progress events emitted in json mode
+const (
+	EventPhaseStart  = "phase_start"
+	EventPhaseFinish = "phase_finish"
+	EventStepStart   = "step_start"
+	EventStepFinish  = "step_finish"
+	EventCacheHit    = "cache_hit"
+	EventLog         = "log"
+	EventError       = "error"
+)
+
+// ProgressEvent is an event of build progress, which is written as a line of JSON in json mode.
+type ProgressEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Builder  string    `json:"builder"`            // docker or buildkit
+	Phase    string    `json:"phase,omitempty"`    // build or push
+	Step     string    `json:"step,omitempty"`     // ID of the step, the step number or the digest of vertex
+	Name     string    `json:"name,omitempty"`     // Name of the step such as `RUN make`
+	Cached   bool      `json:"cached,omitempty"`   // Whether the step hit the cache
+	Duration float64   `json:"duration,omitempty"` // Duration of the step or phase in seconds
+	Stream   string    `json:"stream,omitempty"`   // stdout or stderr of log
+	Message  string    `json:"message,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Progress shows the progress of build and push in the specified mode.
+// In json mode, the events are written to stdout one per line, and the other messages are moved to stderr.
+type Progress struct {
+	Mode    string
+	Builder string
+
+	// Whether to show the summary of the build steps after build
+	Summary bool
+
+	// Uncached steps taking longer than this are highlighted in the summary
+	SlowStep time.Duration
+
+	// Log file into which the messages not shown on console are written, nil if not set
+	Log *BuildLog
+
+	// The terminal of stderr, detected before the output is copied into the log file
+	termFd uintptr
+	isTerm bool
+
+	out     io.Writer            // Where the events are written in json mode
+	display io.Writer            // Where the steps of buildkit are rendered, nil not to render
+	phase   string               // The current phase
+	started map[string]time.Time // Start time of each phase
+	steps   map[string]*progressStep
+	order   []string // IDs of the steps in order of start
+	current string   // The current step of the build without buildkit
+}
+
+// progressStep records the state of a build step.
+type progressStep struct {
+	ID       string
+	Name     string
+	Started  time.Time
+	Duration time.Duration
+	Cached   bool
+	Finished bool
+	Error    string
+	Layer    string // Short ID of the image made by the step of the build without buildkit
+	Size     int64  // Size of the layer made by the step, or -1 if unknown
+}
+
+// NewProgress makes Progress in the mode. The mode auto is resolved to tty if stdout is a terminal, otherwise plain.
+func NewProgress(mode string) (*Progress, error) {
+	switch mode {
+	case "", ProgressAuto:
+		mode = ProgressPlain
+		if _, isTerm := term.GetFdInfo(os.Stdout); isTerm {
+			mode = ProgressTTY
+		}
+	case ProgressTTY, ProgressPlain, ProgressJSON, ProgressQuiet:
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q, choose one of %v", mode, strings.Join(ProgressModes, ", "))
+	}
+	termFd, isTerm := term.GetFdInfo(os.Stderr)
+	return &Progress{
+		Mode:     mode,
+		Builder:  "docker",
+		Summary:  true,
+		SlowStep: defaultSlowStep,
+		termFd:   termFd,
+		isTerm:   isTerm,
+		out:      os.Stdout,
+		started:  map[string]time.Time{},
+		steps:    map[string]*progressStep{},
+	}, nil
+}
+
+// Redirect moves the messages written to stdout so that only the events are written there in json mode,
+// and discards them in quiet mode. It returns the function to restore stdout.
+func (p *Progress) Redirect() func() {
+	org := os.Stdout
+	switch p.Mode {
+	case ProgressJSON:
+		p.out = org
+		os.Stdout = os.Stderr
+	case ProgressQuiet:
+		devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			return func() {}
+		}
+		os.Stdout = devnull
+		return func() {
+			os.Stdout = org
+			devnull.Close()
+		}
+	}
+	return func() { os.Stdout = org }
+}
+
+// Emit writes the event in json mode.
+func (p *Progress) Emit(event ProgressEvent) {
+	if p.Mode != ProgressJSON {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Builder = p.Builder
+	if event.Phase == "" {
+		event.Phase = p.phase
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	p.out.Write(append(b, '\n'))
+}
+
+// PhaseStart shows the banner of the phase such as build or push.
+func (p *Progress) PhaseStart(phase string) {
+	p.phase = phase
+	p.started[phase] = time.Now()
+	p.Emit(ProgressEvent{Type: EventPhaseStart})
+	if p.Mode == ProgressTTY || p.Mode == ProgressPlain {
+		fmt.Println()
+		PrintCenter(title(phase)+" start", 30, "-")
+		fmt.Println()
+	}
+}
+
+// PhaseFinish shows the banner of the end of the phase.
+func (p *Progress) PhaseFinish(phase string, err error) {
+	event := ProgressEvent{Type: EventPhaseFinish, Phase: phase, Duration: time.Since(p.started[phase]).Seconds()}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	p.Emit(event)
+	if p.Mode == ProgressTTY || p.Mode == ProgressPlain {
+		PrintCenter(title(phase)+" finish", 30, "-")
+		fmt.Println()
+	}
+}
+
+// title capitalizes the first letter of the phase.
+func title(phase string) string {
+	if phase == "" {
+		return phase
+	}
+	return strings.ToUpper(phase[:1]) + phase[1:]
+}
+
+// Fail emits the error which stops the build, and shows it on stderr, which is not discarded in quiet mode.
+func (p *Progress) Fail(err error) {
+	p.Emit(ProgressEvent{Type: EventError, Error: err.Error()})
+	fmt.Fprintf(os.Stderr, "Error has occurred: %v\n", err)
+	fmt.Fprintln(os.Stderr, "\x1b[31mBuild Failed\x1b[0m")
+}
+
+// stepStart records the start of the step. Returns false if the step has already started.
+func (p *Progress) stepStart(id string, name string, started time.Time) bool {
+	if _, ok := p.steps[id]; ok {
+		return false
+	}
+	p.steps[id] = &progressStep{ID: id, Name: name, Started: started, Size: -1}
+	p.order = append(p.order, id)
+	p.Emit(ProgressEvent{Time: started, Type: EventStepStart, Step: id, Name: name})
+	return true
+}
+
+// stepFinish records the end of the step. Returns false if the step has already finished.
+func (p *Progress) stepFinish(id string, completed time.Time, cached bool, errMsg string) bool {
+	step, ok := p.steps[id]
+	if !ok || step.Finished {
+		return false
+	}
+	step.Finished = true
+	step.Cached = step.Cached || cached
+	step.Duration = completed.Sub(step.Started)
+	step.Error = errMsg
+	if step.Cached {
+		p.Emit(ProgressEvent{Time: completed, Type: EventCacheHit, Step: id, Name: step.Name})
+	}
+	p.Emit(ProgressEvent{
+		Time:     completed,
+		Type:     EventStepFinish,
+		Step:     id,
+		Name:     step.Name,
+		Cached:   step.Cached,
+		Duration: step.Duration.Seconds(),
+		Error:    errMsg,
+	})
+	return true
+}
+
+// The step marker, the cache hit and the image made by a step of the build without buildkit
+var (
+	classicStepPattern  = regexp.MustCompile(`^Step (\d+)/\d+ : (.*)$`)
+	classicCachePattern = regexp.MustCompile(`^\s*---> Using cache$`)
+	classicLayerPattern = regexp.MustCompile(`^\s*---> ([0-9a-f]{12})$`)
+)
+
+// DisplayJSONMessages shows the stream of the build or push without buildkit.
+// The steps in the stream are recorded for the summary in any mode.
+func (p *Progress) DisplayJSONMessages(in io.Reader) error {
+	if p.Mode == ProgressJSON {
+		return p.trackJSONMessages(in)
+	}
+
+	// The status of buildkit in docker daemon, which is not shown by jsonmessage, is rendered like buildctl.
+	if p.Mode != ProgressQuiet {
+		p.display = os.Stderr
+		defer func() { p.display = nil }()
+	}
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.trackJSONMessages(r)
+		io.Copy(ioutil.Discard, r)
+		close(done)
+	}()
+	var err error
+	if p.Mode == ProgressQuiet {
+		err = jsonmessage.DisplayJSONMessagesStream(io.TeeReader(in, w), ioutil.Discard, 0, false, nil)
+	} else {
+		err = jsonmessage.DisplayJSONMessagesStream(io.TeeReader(in, w), os.Stderr, p.termFd, p.isTerm && p.Mode == ProgressTTY, nil)
+	}
+	w.Close()
+	<-done
+	return err
+}
+
+// trackJSONMessages records the steps in the stream of the build or push without buildkit, and emits the events.
+func (p *Progress) trackJSONMessages(in io.Reader) error {
+	dec := json.NewDecoder(in)
+	for {
+		var jm jsonmessage.JSONMessage
+		if err := dec.Decode(&jm); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if jm.Error != nil {
+			p.finishClassicStep(jm.Error.Message)
+			return jm.Error
+		}
+		if jm.ID == buildkitTraceID && jm.Aux != nil {
+			// The build with secrets runs on buildkit in docker daemon, which sends the status in aux.
+			if status, err := decodeBuildkitTrace(jm.Aux); err == nil {
+				p.solveStatus(status)
+			}
+			continue
+		}
+		if jm.Stream != "" {
+			for _, line := range strings.Split(strings.TrimRight(jm.Stream, "\n"), "\n") {
+				p.classicLine(line)
+			}
+		} else if jm.Status != "" && jm.Progress == nil {
+			message := jm.Status
+			if jm.ID != "" {
+				message = jm.ID + ": " + message
+			}
+			p.Emit(ProgressEvent{Type: EventLog, Stream: "stdout", Message: message})
+		}
+	}
+	p.finishClassicStep("")
+	return nil
+}
+
+// classicLine parses a line of the build output without buildkit.
+func (p *Progress) classicLine(line string) {
+	if m := classicStepPattern.FindStringSubmatch(line); m != nil {
+		p.finishClassicStep("")
+		p.current = m[1]
+		p.stepStart(m[1], m[2], time.Now())
+		return
+	}
+	if step, ok := p.steps[p.current]; ok {
+		if classicCachePattern.MatchString(line) {
+			step.Cached = true
+		} else if m := classicLayerPattern.FindStringSubmatch(line); m != nil {
+			step.Layer = m[1]
+		}
+	}
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	p.Emit(ProgressEvent{Type: EventLog, Step: p.current, Stream: "stdout", Message: line})
+}
+
+// finishClassicStep finishes the current step of the build without buildkit.
+func (p *Progress) finishClassicStep(errMsg string) {
+	if p.current != "" {
+		p.stepFinish(p.current, time.Now(), false, errMsg)
+	}
+}
+
+// BuildctlMode returns the value of buildctl --progress for the mode.
+// The output is rawjson except in tty mode without the summary, and rendered by DisplayBuildctl,
+// since the summary requires the vertexes of buildkit.
+func (p *Progress) BuildctlMode() string {
+	if p.Mode == ProgressTTY && !p.Summary {
+		return "tty"
+	}
+	return "rawjson"
+}
+
+// solveStatus is the status of buildkit written by `buildctl build --progress=rawjson`.
+type solveStatus struct {
+	Vertexes []solveVertex `json:"Vertexes"`
+	Logs     []solveLog    `json:"Logs"`
+}
+
+// solveVertex is the status of a step in buildkit.
+type solveVertex struct {
+	Digest    string     `json:"Digest"`
+	Name      string     `json:"Name"`
+	Started   *time.Time `json:"Started"`
+	Completed *time.Time `json:"Completed"`
+	Cached    bool       `json:"Cached"`
+	Error     string     `json:"Error"`
+}
+
+// solveLog is the output of a step in buildkit.
+type solveLog struct {
+	Vertex    string    `json:"Vertex"`
+	Stream    int       `json:"Stream"`
+	Data      []byte    `json:"Data"`
+	Timestamp time.Time `json:"Timestamp"`
+}
+
+// DisplayBuildctl converts the rawjson output of buildctl into the events, and renders the steps
+// into display like the plain output of buildctl. The steps are not rendered if display is nil.
+// The lines which are not the status of buildkit are emitted as log.
+func (p *Progress) DisplayBuildctl(in io.Reader, display io.Writer) error {
+	p.display = display
+	defer func() { p.display = nil }()
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var status solveStatus
+		if err := json.Unmarshal(line, &status); err != nil || !bytes.HasPrefix(bytes.TrimSpace(line), []byte("{")) {
+			if text := strings.TrimSpace(string(line)); text != "" {
+				p.Emit(ProgressEvent{Type: EventLog, Stream: "stderr", Message: text})
+				p.render("%s\n", text)
+			}
+			continue
+		}
+		p.solveStatus(&status)
+	}
+	return scanner.Err()
+}
+
+// solveStatus emits the events for the vertexes and logs in the status of buildkit.
+func (p *Progress) solveStatus(status *solveStatus) {
+	for _, v := range status.Vertexes {
+		if v.Started == nil && v.Completed != nil {
+			v.Started = v.Completed
+		}
+		if v.Started != nil && p.stepStart(v.Digest, v.Name, *v.Started) {
+			p.render("#%d %s\n", p.stepNumber(v.Digest), v.Name)
+		}
+		if v.Completed != nil && p.stepFinish(v.Digest, *v.Completed, v.Cached, v.Error) {
+			step := p.steps[v.Digest]
+			switch {
+			case v.Error != "":
+				p.render("#%d ERROR: %s\n", p.stepNumber(v.Digest), v.Error)
+			case step.Cached:
+				p.render("#%d CACHED\n", p.stepNumber(v.Digest))
+			default:
+				p.render("#%d DONE %.1fs\n", p.stepNumber(v.Digest), step.Duration.Seconds())
+			}
+		}
+	}
+	for _, l := range status.Logs {
+		stream := "stdout"
+		if l.Stream == 2 {
+			stream = "stderr"
+		}
+		for _, line := range strings.Split(strings.TrimRight(string(l.Data), "\n"), "\n") {
+			p.Emit(ProgressEvent{Time: l.Timestamp, Type: EventLog, Step: l.Vertex, Stream: stream, Message: line})
+			p.render("#%d %s\n", p.stepNumber(l.Vertex), line)
+		}
+	}
+}
+
+// render writes the rendered output of buildkit into display.
+func (p *Progress) render(format string, a ...interface{}) {
+	if p.display != nil {
+		fmt.Fprintf(p.display, format, a...)
+	}
+}
+
+// stepNumber returns the number of the step in order of start, which begins with 1.
+func (p *Progress) stepNumber(id string) int {
+	for i, stepID := range p.order {
+		if stepID == id {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+package dbyml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProgress(t *testing.T) {
+	for _, mode := range []string{ProgressTTY, ProgressPlain, ProgressJSON, ProgressQuiet} {
+		p, err := NewProgress(mode)
+		assert.Nil(t, err)
+		assert.Equal(t, mode, p.Mode)
+	}
+	p, err := NewProgress(ProgressAuto)
+	assert.Nil(t, err)
+	assert.Contains(t, []string{ProgressTTY, ProgressPlain}, p.Mode)
+
+	_, err = NewProgress("fancy")
+	assert.Error(t, err)
+
+	p, _ = NewProgress(ProgressJSON)
+	assert.Equal(t, "rawjson", p.BuildctlMode())
+	p, _ = NewProgress(ProgressTTY)
+	assert.Equal(t, "rawjson", p.BuildctlMode())
+	p.Summary = false
+	assert.Equal(t, "tty", p.BuildctlMode())
+}
+
+// decodeEvents returns the events written by Progress in json mode.
+func decodeEvents(t *testing.T, buf *bytes.Buffer) []ProgressEvent {
+	t.Helper()
+	events := []ProgressEvent{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event ProgressEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// The error which stops the build is shown even in quiet mode.
+func TestProgressFailQuiet(t *testing.T) {
+	orgStderr := os.Stderr
+	r, w, _ := os.Pipe()
+	os.Stderr = w
+	stdout := extractStdout(t, func() {
+		p, _ := NewProgress(ProgressQuiet)
+		restore := p.Redirect()
+		fmt.Println("hidden")
+		p.Fail(fmt.Errorf("returned a non-zero code: 1"))
+		restore()
+	})
+	os.Stderr = orgStderr
+	w.Close()
+	stderr, _ := ioutil.ReadAll(r)
+	assert.Empty(t, stdout)
+	assert.Equal(t, "Error has occurred: returned a non-zero code: 1\n\x1b[31mBuild Failed\x1b[0m\n", string(stderr))
+}
+
+func TestDisplayJSONMessages(t *testing.T) {
+	stream := `{"stream":"Step 1/2 : FROM alpine:3.16"}
+{"stream":"\n"}
+{"stream":" ---> 9c6f07244728\n"}
+{"stream":"Step 2/2 : RUN apk add curl"}
+{"stream":"\n"}
+{"stream":" ---> Using cache\n"}
+{"stream":" ---> 0d3c3f7b2b1a\n"}
+{"stream":"Successfully built 0d3c3f7b2b1a\n"}
+`
+	var buf bytes.Buffer
+	p, _ := NewProgress(ProgressJSON)
+	p.out = &buf
+	p.PhaseStart("build")
+	err := p.DisplayJSONMessages(strings.NewReader(stream))
+	assert.Nil(t, err)
+	p.PhaseFinish("build", err)
+
+	types := []string{}
+	for _, e := range decodeEvents(t, &buf) {
+		assert.Equal(t, "docker", e.Builder)
+		assert.Equal(t, "build", e.Phase)
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{
+		EventPhaseStart,
+		EventStepStart, EventLog, EventStepFinish,
+		EventStepStart, EventLog, EventLog, EventLog, EventCacheHit, EventStepFinish,
+		EventPhaseFinish,
+	}, types)
+	assert.False(t, p.steps["1"].Cached)
+	assert.True(t, p.steps["2"].Cached)
+	assert.Equal(t, "RUN apk add curl", p.steps["2"].Name)
+
+	buf.Reset()
+	p, _ = NewProgress(ProgressJSON)
+	p.out = &buf
+	err = p.DisplayJSONMessages(strings.NewReader(`{"stream":"Step 1/1 : RUN false"}
+{"errorDetail":{"code":1,"message":"returned a non-zero code: 1"},"error":"returned a non-zero code: 1"}
+`))
+	assert.Error(t, err)
+	events := decodeEvents(t, &buf)
+	assert.Equal(t, EventStepFinish, events[len(events)-1].Type)
+	assert.Equal(t, "returned a non-zero code: 1", events[len(events)-1].Error)
+
+	// The build with secrets sends the status of buildkit in docker daemon.
+	buf.Reset()
+	p, _ = NewProgress(ProgressJSON)
+	p.out = &buf
+	completed := time.Date(2022, 6, 1, 0, 0, 1, 0, time.UTC)
+	err = p.DisplayJSONMessages(strings.NewReader(buildkitTrace("sha256:abc", "[1/1] RUN true", completed, "hello\n")))
+	assert.Nil(t, err)
+	events = decodeEvents(t, &buf)
+	types = []string{}
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{EventStepStart, EventStepFinish, EventLog}, types)
+	assert.Equal(t, "sha256:abc", events[2].Step)
+	assert.Equal(t, "hello", events[2].Message)
+}
+
+func TestDisplayBuildctl(t *testing.T) {
+	output := `{"Vertexes":[{"Digest":"sha256:aaa","Name":"[1/2] FROM docker.io/library/alpine:3.16","Started":"2022-06-01T00:00:00Z"}]}
+{"Vertexes":[{"Digest":"sha256:aaa","Name":"[1/2] FROM docker.io/library/alpine:3.16","Started":"2022-06-01T00:00:00Z","Completed":"2022-06-01T00:00:01Z","Cached":true}]}
+{"Vertexes":[{"Digest":"sha256:bbb","Name":"[2/2] RUN make","Started":"2022-06-01T00:00:01Z"}],"Logs":[{"Vertex":"sha256:bbb","Stream":1,"Data":"Y2MgLW8gYXBwCg==","Timestamp":"2022-06-01T00:00:02Z"}]}
+{"Vertexes":[{"Digest":"sha256:bbb","Name":"[2/2] RUN make","Started":"2022-06-01T00:00:01Z","Completed":"2022-06-01T00:00:05Z"}]}
+error: failed to solve
+`
+	var buf bytes.Buffer
+	p, _ := NewProgress(ProgressJSON)
+	p.Builder = "buildkit"
+	p.out = &buf
+	var display bytes.Buffer
+	err := p.DisplayBuildctl(strings.NewReader(output), &display)
+	assert.Nil(t, err)
+	expected := `#1 [1/2] FROM docker.io/library/alpine:3.16
+#1 CACHED
+#2 [2/2] RUN make
+#2 cc -o app
+#2 DONE 4.0s
+error: failed to solve
+`
+	assert.Equal(t, expected, display.String())
+
+	events := decodeEvents(t, &buf)
+	types := []string{}
+	for _, e := range events {
+		assert.Equal(t, "buildkit", e.Builder)
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{
+		EventStepStart, EventCacheHit, EventStepFinish,
+		EventStepStart, EventLog, EventStepFinish,
+		EventLog,
+	}, types)
+	assert.Equal(t, "cc -o app", events[4].Message)
+	assert.Equal(t, "sha256:bbb", events[4].Step)
+	assert.Equal(t, 4.0, events[5].Duration)
+	assert.Equal(t, "error: failed to solve", events[6].Message)
+}
@@ -20,8 +20,8 @@ type RegistryInfo struct {
 	// Project name
 	Project string `yaml:"project"`
 
-	// credentials settings to a registry
-	Auth map[string]string `yaml:"auth"`
+	// credentials settings to a registry, where the values may be read from files, environment variables or commands
+	Auth map[string]*SecretValue `yaml:"auth"`
 
 	Insecure bool `yaml:"insecure"`
 }
@@ -48,9 +48,30 @@ func (registry RegistryInfo) ShowProperties() {
 	}
 }
 
+// AuthValue returns the value of the key in auth, which is empty if the key is not set.
+func (registry *RegistryInfo) AuthValue(key string) (string, error) {
+	value, ok := registry.Auth[key]
+	if !ok || value == nil {
+		return "", nil
+	}
+	v, err := value.Value()
+	if err != nil {
+		return "", fmt.Errorf("registry.auth.%v: %v", key, err)
+	}
+	return v, nil
+}
+
 // BasicAuth returns base64 the encoded credentials for the registry.
-func (registry *RegistryInfo) BasicAuth() string {
-	return GetAuthBase64(registry.Auth["username"], registry.Auth["password"])
+func (registry *RegistryInfo) BasicAuth() (string, error) {
+	username, err := registry.AuthValue("username")
+	if err != nil {
+		return "", err
+	}
+	password, err := registry.AuthValue("password")
+	if err != nil {
+		return "", err
+	}
+	return GetAuthBase64(username, password), nil
 }
 
 // GetAuthBase64 encodes credentials for the registry with base64.
@@ -0,0 +1,151 @@
+package dbyml
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// IsRemoteContext returns true if the build context is a URL to a Git repository or a tarball.
+func IsRemoteContext(path string) bool {
+	return IsGitURL(path) || isHTTPURL(path)
+}
+
+// IsGitURL returns true if the build context is a URL to a Git repository, such as
+// `git@host:org/repo.git#ref:subdir` or `https://host/org/repo.git#tag`.
+func IsGitURL(path string) bool {
+	url := strings.SplitN(path, "#", 2)[0]
+	switch {
+	case strings.HasPrefix(url, "git@"), strings.HasPrefix(url, "git://"):
+		return true
+	case isHTTPURL(url), strings.HasPrefix(url, "ssh://"), strings.HasPrefix(url, "file://"):
+		return strings.HasSuffix(url, ".git")
+	}
+	return false
+}
+
+func isHTTPURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// ParseGitURL splits a Git URL into the repository, ref and subdirectory.
+// The ref and subdirectory are given in the fragment as `#ref:subdir`.
+func ParseGitURL(url string) (repo string, ref string, subdir string) {
+	arr := strings.SplitN(url, "#", 2)
+	repo = arr[0]
+	if len(arr) == 2 {
+		frag := strings.SplitN(arr[1], ":", 2)
+		ref = frag[0]
+		if len(frag) == 2 {
+			subdir = frag[1]
+		}
+	}
+	return repo, ref, subdir
+}
+
+// FetchRemoteContext fetches a remote build context into a temporary directory on host.
+// It returns the directory of the build context and the function to remove the fetched files.
+// The fetch is stopped when ctx is cancelled.
+func FetchRemoteContext(ctx context.Context, url string) (string, func(), error) {
+	root, err := ioutil.TempDir("", "dbyml-context-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(root) }
+
+	dir := root
+	if IsGitURL(url) {
+		dir, err = fetchGitContext(ctx, url, root)
+	} else {
+		err = fetchTarballContext(ctx, url, root)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// fetchGitContext checks out the ref of a Git repository into root and returns the directory of the build context.
+func fetchGitContext(ctx context.Context, url string, root string) (string, error) {
+	repo, ref, subdir := ParseGitURL(url)
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	if err := git(ctx, root, "init", "-q"); err != nil {
+		return "", err
+	}
+	if err := git(ctx, root, "remote", "add", "origin", repo); err != nil {
+		return "", err
+	}
+	// Fetch only the ref if possible, otherwise fetch the whole history for a commit ref.
+	if err := git(ctx, root, "fetch", "-q", "--depth", "1", "origin", ref); err == nil {
+		if err = git(ctx, root, "checkout", "-q", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+	} else {
+		if err = git(ctx, root, "fetch", "-q", "origin"); err != nil {
+			return "", err
+		}
+		if err = git(ctx, root, "checkout", "-q", ref); err != nil {
+			return "", err
+		}
+	}
+	if err := git(ctx, root, "submodule", "update", "-q", "--init", "--recursive", "--depth", "1"); err != nil {
+		return "", err
+	}
+
+	dir, err := joinInside(root, subdir)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("subdirectory %v not found in %v", subdir, repo)
+	}
+	return dir, nil
+}
+
+func git(ctx context.Context, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %v failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// fetchTarballContext downloads a tar archive, which may be compressed with gzip, and extracts it into root.
+func fetchTarballContext(ctx context.Context, url string, root string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %v: %v", url, res.Status)
+	}
+
+	var reader io.Reader = bufio.NewReader(res.Body)
+	if magic, _ := reader.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		reader = gr
+	}
+	return extractTar(reader, root, "")
+}
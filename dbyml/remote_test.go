@@ -0,0 +1,116 @@
+package dbyml
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRemoteContext(t *testing.T) {
+	tests := []struct {
+		path   string
+		git    bool
+		remote bool
+	}{
+		{".", false, false},
+		{"testdata/dockerfile_standard", false, false},
+		{"git@github.com:git-ogawa/go-dbyml.git#main:testdata", true, true},
+		{"git://github.com/git-ogawa/go-dbyml", true, true},
+		{"https://github.com/git-ogawa/go-dbyml.git#v1.2.1", true, true},
+		{"ssh://git@github.com/git-ogawa/go-dbyml.git", true, true},
+		{"file:///tmp/repo.git#main", true, true},
+		{"https://example.com/context.tar.gz", false, true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.git, IsGitURL(tt.path), tt.path)
+		assert.Equal(t, tt.remote, IsRemoteContext(tt.path), tt.path)
+	}
+
+	repo, ref, subdir := ParseGitURL("git@github.com:git-ogawa/go-dbyml.git#main:testdata/dockerfile_standard")
+	assert.Equal(t, "git@github.com:git-ogawa/go-dbyml.git", repo)
+	assert.Equal(t, "main", ref)
+	assert.Equal(t, "testdata/dockerfile_standard", subdir)
+}
+
+func TestFetchGitContext(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	// Make a bare repository with the tag v1 which has a Dockerfile in the subdirectory.
+	work := t.TempDir()
+	bare := filepath.Join(t.TempDir(), "repo.git")
+	os.MkdirAll(filepath.Join(work, "app"), 0o755)
+	ioutil.WriteFile(filepath.Join(work, "app", "Dockerfile"), []byte("FROM alpine:latest\n"), 0o644)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+		{"tag", "v1"},
+		{"clone", "-q", "--bare", ".", bare},
+	} {
+		if err := git(context.Background(), work, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, cleanup, err := FetchRemoteContext(context.Background(), "file://"+bare+"#v1:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	b, err := ioutil.ReadFile(filepath.Join(dir, "Dockerfile"))
+	assert.Nil(t, err)
+	assert.Equal(t, "FROM alpine:latest\n", string(b))
+
+	_, _, err = FetchRemoteContext(context.Background(), "file://"+bare+"#v1:notexists")
+	assert.Error(t, err)
+}
+
+func TestFetchTarballContext(t *testing.T) {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	content := []byte("FROM alpine:latest\n")
+	tw.WriteHeader(&tar.Header{Name: "context/Dockerfile", Mode: 0o644, Size: int64(len(content))})
+	tw.Write(content)
+	tw.Close()
+	gw.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/context.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	dir, cleanup, err := FetchRemoteContext(context.Background(), server.URL+"/context.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	b, err := ioutil.ReadFile(filepath.Join(dir, "context", "Dockerfile"))
+	assert.Nil(t, err)
+	assert.Equal(t, content, b)
+
+	_, _, err = FetchRemoteContext(context.Background(), server.URL+"/notfound.tar.gz")
+	assert.Error(t, err)
+
+	// The fetch is stopped when the build is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = FetchRemoteContext(ctx, server.URL+"/context.tar.gz")
+	assert.ErrorIs(t, err, context.Canceled)
+}
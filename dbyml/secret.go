@@ -0,0 +1,96 @@
+package dbyml
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+)
+
+var secretIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// SecretSpec defines a build secret used by `RUN --mount=type=secret,id=...` in Dockerfile.
+// The value is read from the file src or the environment variable env on host.
+type SecretSpec struct {
+	ID  string `yaml:"id"`
+	Src string `yaml:"src"`
+	Env string `yaml:"env"`
+}
+
+// Validate checks the secret has an id and exactly one of src or env.
+func (secret *SecretSpec) Validate() error {
+	if secret.ID == "" {
+		return fmt.Errorf("secret requires id")
+	}
+	if !secretIDPattern.MatchString(secret.ID) || secret.ID == "." || secret.ID == ".." {
+		return fmt.Errorf("secret id %q must consist of alphanumerics, '.', '_' and '-'", secret.ID)
+	}
+	if (secret.Src == "") == (secret.Env == "") {
+		return fmt.Errorf("secret %v requires either src or env", secret.ID)
+	}
+	return nil
+}
+
+// Value reads the value of the secret.
+func (secret *SecretSpec) Value() ([]byte, error) {
+	if err := secret.Validate(); err != nil {
+		return nil, err
+	}
+	if secret.Src != "" {
+		b, err := ioutil.ReadFile(secret.Src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret %v: %v", secret.ID, err)
+		}
+		return b, nil
+	}
+	v, ok := os.LookupEnv(secret.Env)
+	if !ok {
+		return nil, fmt.Errorf("failed to read secret %v: ENV %v not defined", secret.ID, secret.Env)
+	}
+	return []byte(v), nil
+}
+
+// Source returns the description of where the secret is read from, which does not contain the value.
+func (secret *SecretSpec) Source() string {
+	if secret.Src != "" {
+		return "src=" + secret.Src
+	}
+	return "env=" + secret.Env
+}
+
+// secretArchive makes a tar archive containing the value of each secret as the file `dir/id`,
+// which is readable only by the owner.
+func secretArchive(secrets []SecretSpec, dir string) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	ids := map[string]bool{}
+	for _, secret := range secrets {
+		if ids[secret.ID] {
+			return nil, fmt.Errorf("secret %v is defined more than once", secret.ID)
+		}
+		ids[secret.ID] = true
+
+		value, err := secret.Value()
+		if err != nil {
+			return nil, err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    dir + "/" + secret.ID,
+			Mode:    0o400,
+			ModTime: time.Now(),
+			Size:    int64(len(value)),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(value); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,117 @@
+package dbyml
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretValue(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "npmrc")
+	ioutil.WriteFile(src, []byte("//registry.npmjs.org/:_authToken=file-token"), 0o600)
+	os.Setenv("DBYML_TEST_TOKEN", "env-token")
+	defer os.Unsetenv("DBYML_TEST_TOKEN")
+
+	tests := []struct {
+		secret SecretSpec
+		value  string
+		valid  bool
+	}{
+		{SecretSpec{ID: "npmrc", Src: src}, "//registry.npmjs.org/:_authToken=file-token", true},
+		{SecretSpec{ID: "token", Env: "DBYML_TEST_TOKEN"}, "env-token", true},
+		{SecretSpec{ID: "token", Env: "DBYML_TEST_UNDEFINED"}, "", false},
+		{SecretSpec{ID: "missing", Src: filepath.Join(t.TempDir(), "missing")}, "", false},
+		{SecretSpec{ID: "both", Src: src, Env: "DBYML_TEST_TOKEN"}, "", false},
+		{SecretSpec{ID: "none"}, "", false},
+		{SecretSpec{Src: src}, "", false},
+		{SecretSpec{ID: "../escape", Src: src}, "", false},
+	}
+	for _, tt := range tests {
+		value, err := tt.secret.Value()
+		assert.Equal(t, tt.valid, err == nil, "%+v: %v", tt.secret, err)
+		assert.Equal(t, tt.value, string(value))
+	}
+}
+
+func TestSecretArchive(t *testing.T) {
+	os.Setenv("DBYML_TEST_TOKEN", "env-token")
+	defer os.Unsetenv("DBYML_TEST_TOKEN")
+
+	secrets := []SecretSpec{{ID: "token", Env: "DBYML_TEST_TOKEN"}}
+	buf, err := secretArchive(secrets, "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "secrets/token", hdr.Name)
+	assert.Equal(t, int64(0o400), hdr.Mode)
+	b, _ := io.ReadAll(tr)
+	assert.Equal(t, "env-token", string(b))
+
+	secrets = append(secrets, SecretSpec{ID: "token", Env: "DBYML_TEST_TOKEN"})
+	_, err = secretArchive(secrets, "secrets")
+	assert.Error(t, err)
+}
+
+// The values of secrets never appear in the build settings shown on build.
+func TestShowSecrets(t *testing.T) {
+	os.Setenv("DBYML_TEST_TOKEN", "env-token")
+	defer os.Unsetenv("DBYML_TEST_TOKEN")
+
+	image := NewImageInfo()
+	image.Basename = "test"
+	image.Secrets = []SecretSpec{{ID: "token", Env: "DBYML_TEST_TOKEN"}, {ID: "npmrc", Src: "/run/secrets/npmrc"}}
+	stdout := extractStdout(t, image.ShowProperties)
+	assert.Contains(t, stdout, "token: env=DBYML_TEST_TOKEN")
+	assert.Contains(t, stdout, "npmrc: src=/run/secrets/npmrc")
+	assert.NotContains(t, stdout, "env-token")
+}
+
+// The build without buildkit builder passes the secrets through the session with docker daemon.
+func TestClassicBuildSecretsFake(t *testing.T) {
+	pwd, _ := os.Getwd()
+	root, _ := filepath.Abs("../")
+	os.Chdir(root)
+	defer os.Chdir(pwd)
+	os.Setenv("DBYML_TEST_TOKEN", "env-token")
+	defer os.Unsetenv("DBYML_TEST_TOKEN")
+	src := filepath.Join(t.TempDir(), "npmrc")
+	ioutil.WriteFile(src, []byte("file-token"), 0o600)
+
+	fake := newFakeDocker()
+	fake.buildSecrets = []string{"token", "npmrc"}
+	// The status of buildkit in docker daemon is recorded as the steps.
+	fake.buildOutput = buildkitTrace("sha256:run", "[1/1] RUN --mount=type=secret,id=token true", time.Now(), "done\n") + "\n"
+	image := NewImageInfo()
+	image.Basename = "gotest"
+	image.Context = "testdata/dockerfile_standard"
+	image.SetProperties()
+	image.DockerClient = fake
+	image.Progress, _ = NewProgress(ProgressQuiet)
+	image.Secrets = []SecretSpec{{ID: "token", Env: "DBYML_TEST_TOKEN"}, {ID: "npmrc", Src: src}}
+
+	assert.Nil(t, image.Build(context.Background()))
+	assert.Equal(t, map[string]string{"token": "env-token", "npmrc": "file-token"}, fake.secrets)
+	assert.Equal(t, types.BuilderBuildKit, fake.builds[0].Version)
+	assert.NotEmpty(t, fake.builds[0].SessionID)
+	assert.Equal(t, []string{"sha256:run"}, image.Progress.order)
+
+	// The secret which cannot be read fails the build before it starts.
+	fake = newFakeDocker()
+	image.DockerClient = fake
+	image.Secrets = []SecretSpec{{ID: "token", Env: "DBYML_TEST_UNDEFINED"}}
+	assert.EqualError(t, image.Build(context.Background()), "failed to read secret token: ENV DBYML_TEST_UNDEFINED not defined")
+	assert.Empty(t, fake.Calls())
+}
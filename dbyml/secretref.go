@@ -0,0 +1,167 @@
+package dbyml
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The text shown instead of the values read from secret references
+const redactedValue = "*********"
+
+// SecretValue is a value written in config file as it is, or a reference to where the value is read from.
+//
+//	password: plain-text
+//	password: {file: /run/secrets/regpass}      # The content of the file
+//	password: {env: REG_PASS}                   # The environment variable of the process
+//	password: {command: [pass, show, registry]} # The output of the command
+//
+// The reference is resolved on the first call of Value, and the value read from it is redacted from
+// the output such as the buildctl command and the log file.
+type SecretValue struct {
+	Plain   string
+	File    string
+	Env     string
+	Command []string
+
+	once  sync.Once
+	value string
+	err   error
+}
+
+// NewSecretValue returns the value written in config file as it is.
+func NewSecretValue(plain string) *SecretValue {
+	return &SecretValue{Plain: plain}
+}
+
+// UnmarshalYAML reads the value as a string or a map of file, env or command.
+func (secret *SecretValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var plain string
+	if err := unmarshal(&plain); err == nil {
+		secret.Plain = plain
+		return nil
+	}
+	var ref struct {
+		File    string   `yaml:"file"`
+		Env     string   `yaml:"env"`
+		Command []string `yaml:"command"`
+	}
+	if err := unmarshal(&ref); err != nil {
+		return fmt.Errorf("secret value must be a string or a map of file, env or command")
+	}
+	n := 0
+	for _, set := range []bool{ref.File != "", ref.Env != "", len(ref.Command) != 0} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("secret value requires exactly one of file, env or command")
+	}
+	secret.File, secret.Env, secret.Command = ref.File, ref.Env, ref.Command
+	return nil
+}
+
+// IsRef returns true if the value is read from a file, an environment variable or a command.
+func (secret *SecretValue) IsRef() bool {
+	return secret.File != "" || secret.Env != "" || len(secret.Command) != 0
+}
+
+// Value returns the value, reading it from the reference on the first call.
+func (secret *SecretValue) Value() (string, error) {
+	if !secret.IsRef() {
+		return secret.Plain, nil
+	}
+	secret.once.Do(func() {
+		secret.value, secret.err = secret.resolve()
+		if secret.err == nil {
+			addRedaction(secret.value)
+		}
+	})
+	return secret.value, secret.err
+}
+
+// resolve reads the value from the reference. The trailing newline of the file or the output is removed.
+func (secret *SecretValue) resolve() (string, error) {
+	switch {
+	case secret.File != "":
+		path, err := expandHome(secret.File)
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret from %v: %v", secret.File, err)
+		}
+		return trimNewline(string(b)), nil
+	case secret.Env != "":
+		v, ok := os.LookupEnv(secret.Env)
+		if !ok {
+			return "", fmt.Errorf("failed to read secret: ENV %v not defined", secret.Env)
+		}
+		return v, nil
+	default:
+		var stderr bytes.Buffer
+		cmd := exec.Command(secret.Command[0], secret.Command[1:]...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				err = fmt.Errorf("%v: %v", err, msg)
+			}
+			return "", fmt.Errorf("failed to read secret from command %v: %v", secret.Command[0], err)
+		}
+		return trimNewline(string(out)), nil
+	}
+}
+
+// String returns the plain value, or the reference without the value read from it.
+func (secret *SecretValue) String() string {
+	switch {
+	case secret.File != "":
+		return fmt.Sprintf("{file: %v}", secret.File)
+	case secret.Env != "":
+		return fmt.Sprintf("{env: %v}", secret.Env)
+	case len(secret.Command) != 0:
+		return fmt.Sprintf("{command: [%v]}", strings.Join(secret.Command, ", "))
+	}
+	return secret.Plain
+}
+
+func trimNewline(s string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(s, "\n"), "\r")
+}
+
+// The values read from secret references, which are redacted by Redact
+var redactions = struct {
+	sync.Mutex
+	values []string
+}{}
+
+func addRedaction(value string) {
+	if value == "" {
+		return
+	}
+	redactions.Lock()
+	defer redactions.Unlock()
+	redactions.values = append(redactions.values, value)
+	// The longer value is replaced first, so that the value containing another one is not left partially.
+	sort.Slice(redactions.values, func(i, j int) bool {
+		return len(redactions.values[i]) > len(redactions.values[j])
+	})
+}
+
+// Redact replaces the values read from secret references in s.
+func Redact(s string) string {
+	redactions.Lock()
+	defer redactions.Unlock()
+	for _, v := range redactions.values {
+		s = strings.ReplaceAll(s, v, redactedValue)
+	}
+	return s
+}
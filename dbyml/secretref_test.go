@@ -0,0 +1,247 @@
+package dbyml
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestSecretValueUnmarshal(t *testing.T) {
+	var values map[string]*SecretValue
+	data := `
+plain: text
+number: 3
+file: {file: /run/secrets/regpass}
+env: {env: REG_PASS}
+command: {command: [pass, show, registry]}
+empty:
+`
+	assert.Nil(t, yaml.Unmarshal([]byte(data), &values))
+	assert.Equal(t, &SecretValue{Plain: "text"}, values["plain"])
+	assert.Equal(t, &SecretValue{Plain: "3"}, values["number"])
+	assert.Equal(t, &SecretValue{File: "/run/secrets/regpass"}, values["file"])
+	assert.Equal(t, &SecretValue{Env: "REG_PASS"}, values["env"])
+	assert.Equal(t, &SecretValue{Command: []string{"pass", "show", "registry"}}, values["command"])
+	assert.Nil(t, values["empty"])
+
+	assert.Equal(t, "text", values["plain"].String())
+	assert.Equal(t, "{file: /run/secrets/regpass}", values["file"].String())
+	assert.Equal(t, "{env: REG_PASS}", values["env"].String())
+	assert.Equal(t, "{command: [pass, show, registry]}", values["command"].String())
+
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{"v: {file: a, env: B}", "secret value requires exactly one of file, env or command"},
+		{"v: {path: a}", "secret value requires exactly one of file, env or command"},
+		{"v: [a, b]", "secret value must be a string or a map of file, env or command"},
+	}
+	for _, tt := range tests {
+		err := yaml.Unmarshal([]byte(tt.data), &values)
+		assert.EqualError(t, err, tt.err, tt.data)
+	}
+}
+
+func TestSecretValueResolve(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "regpass")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("from-file-7c1e\n"), 0o600))
+	t.Setenv("DBYML_TEST_SECRET", "from-env-2b9d")
+
+	file := &SecretValue{File: path}
+	v, err := file.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, "from-file-7c1e", v)
+
+	// The value is read only once.
+	assert.Nil(t, ioutil.WriteFile(path, []byte("changed"), 0o600))
+	v, _ = file.Value()
+	assert.Equal(t, "from-file-7c1e", v)
+
+	v, err = (&SecretValue{Env: "DBYML_TEST_SECRET"}).Value()
+	assert.Nil(t, err)
+	assert.Equal(t, "from-env-2b9d", v)
+
+	v, err = (&SecretValue{Command: []string{"echo", "from-command-5f3a"}}).Value()
+	assert.Nil(t, err)
+	assert.Equal(t, "from-command-5f3a", v)
+
+	v, err = NewSecretValue("plain-text").Value()
+	assert.Nil(t, err)
+	assert.Equal(t, "plain-text", v)
+
+	_, err = (&SecretValue{Env: "DBYML_TEST_UNDEFINED"}).Value()
+	assert.EqualError(t, err, "failed to read secret: ENV DBYML_TEST_UNDEFINED not defined")
+	_, err = (&SecretValue{File: filepath.Join(dir, "notexists")}).Value()
+	assert.Contains(t, err.Error(), "failed to read secret from "+filepath.Join(dir, "notexists"))
+	_, err = (&SecretValue{Command: []string{"sh", "-c", "echo 'not found in store' >&2; exit 1"}}).Value()
+	assert.EqualError(t, err, "failed to read secret from command sh: exit status 1: not found in store")
+
+	// Only the values read from references are redacted.
+	assert.Equal(t, "-p ********* -e ********* -c ********* plain-text", Redact("-p from-file-7c1e -e from-env-2b9d -c from-command-5f3a plain-text"))
+}
+
+func TestSecretValueBuildArgs(t *testing.T) {
+	t.Setenv("DBYML_TEST_NPM_TOKEN", "npm-token-9e4f")
+	t.Setenv("DBYML_TEST_FROM_ENV", "from-env")
+	image := NewImageInfo()
+	image.BuildArgs = map[string]*SecretValue{
+		"NPM_TOKEN":           {Env: "DBYML_TEST_NPM_TOKEN"},
+		"DBYML_TEST_FROM_ENV": nil,
+	}
+
+	// The references are not read on show.
+	stdout := extractStdout(t, image.ShowProperties)
+	assert.Contains(t, stdout, "NPM_TOKEN: {env: DBYML_TEST_NPM_TOKEN}")
+	assert.NotContains(t, stdout, "npm-token-9e4f")
+
+	opts := parseOptions(t, NewBuildkitInfo(), *image)
+	assert.Contains(t, opts, "build-arg:NPM_TOKEN=npm-token-9e4f")
+	assert.Contains(t, opts, "build-arg:DBYML_TEST_FROM_ENV=from-env")
+	assert.NotContains(t, Redact(strings.Join(opts, " ")), "npm-token-9e4f")
+
+	image.BuildArgs["MISSING"] = &SecretValue{Env: "DBYML_TEST_UNDEFINED"}
+	_, err := NewBuildkitInfo().ParseOptions(*image)
+	assert.EqualError(t, err, "build arg MISSING: failed to read secret: ENV DBYML_TEST_UNDEFINED not defined")
+}
+
+func TestSecretValueRegistryAuth(t *testing.T) {
+	registry := NewRegistryInfo()
+	registry.Auth = map[string]*SecretValue{
+		"username": NewSecretValue("ci"),
+		"password": {Command: []string{"echo", "registry-pass-3d8a"}},
+	}
+	_, err := registry.BasicAuth()
+	assert.Nil(t, err)
+
+	// The value read from the reference is not written into the log file.
+	var buf bytes.Buffer
+	s := &ansiStripper{out: &buf}
+	s.Write([]byte("login with registry-pass-3d8a\n"))
+	assert.Equal(t, "login with *********\n", buf.String())
+	// The value split across writes is also redacted, and the last line is written on flush.
+	buf.Reset()
+	s.Write([]byte("retry with registry-pa"))
+	s.Write([]byte("ss-3d8a\nlogin with registry-"))
+	assert.Equal(t, "retry with *********\n", buf.String())
+	s.Write([]byte("pass-3d8a"))
+	assert.Nil(t, s.Flush())
+	assert.Equal(t, "retry with *********\nlogin with *********", buf.String())
+
+	registry.Auth["password"] = &SecretValue{File: "/notexists/regpass"}
+	_, err = registry.BasicAuth()
+	assert.Contains(t, err.Error(), "registry.auth.password: failed to read secret from /notexists/regpass")
+}
+
+func TestShowConfigFileRedactPassword(t *testing.T) {
+	t.Setenv("DBYML_TEST_GITHUB_TOKEN", "github-token-1c9a")
+	addRedaction("resolved-secret-8d1f")
+	writeConfigFiles(t, map[string]string{
+		"dbyml.yml": `
+image:
+  build_args:
+    NPM_TOKEN: {env: NPM_TOKEN}
+    GITHUB_TOKEN: ${DBYML_TEST_GITHUB_TOKEN}
+  label:
+    token: resolved-secret-8d1f
+registry:
+  auth:
+    username: ci
+    password: plain-pass-6a2c
+`,
+	})
+	file, err := ReadConfigFile("dbyml.yml", nil)
+	assert.Nil(t, err)
+	// The references are resolved on build, not on load.
+	conf := NewConfiguration()
+	assert.Nil(t, file.Decode(conf))
+	assert.Equal(t, &SecretValue{Env: "NPM_TOKEN"}, conf.ImageInfo.BuildArgs["NPM_TOKEN"])
+
+	var buf bytes.Buffer
+	assert.Nil(t, file.Show(&buf, false))
+	// The values of SecretValue written directly and the values read from references are not shown.
+	assert.Equal(t, `image:
+  build_args:
+    NPM_TOKEN:
+      env: NPM_TOKEN
+    GITHUB_TOKEN: *********
+  label:
+    token: *********
+registry:
+  auth:
+    username: ci
+    password: *********
+`, buf.String())
+}
+
+func TestSecretValueOverride(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"base.yml": `
+image:
+  build_args:
+    NPM_TOKEN: {file: /run/secrets/npm}
+    GO_VERSION: "1.18"
+registry:
+  auth:
+    username: ci
+    password: {file: /run/secrets/regpass}
+`,
+		"dbyml.yml": `
+extends: base.yml
+image:
+  build_args:
+    NPM_TOKEN: plain-token
+registry:
+  auth:
+    password: {env: REG_PASS}
+profiles:
+  ci:
+    registry:
+      auth:
+        password: {command: [pass, show, registry]}
+`,
+	})
+
+	// The reference replaces the inherited reference instead of being merged with it.
+	file, err := ReadConfigFile("dbyml.yml", nil)
+	assert.Nil(t, err)
+	conf := NewConfiguration()
+	assert.Nil(t, file.Decode(conf))
+	assert.Equal(t, &SecretValue{Env: "REG_PASS"}, conf.RegistryInfo.Auth["password"])
+	assert.Equal(t, NewSecretValue("ci"), conf.RegistryInfo.Auth["username"])
+	assert.Equal(t, NewSecretValue("plain-token"), conf.ImageInfo.BuildArgs["NPM_TOKEN"])
+	assert.Equal(t, "dbyml.yml", file.Origin("registry.auth.password.env"))
+	assert.Equal(t, defaultOrigin, file.Origin("registry.auth.password.file"))
+
+	assert.Nil(t, file.ApplyProfile("ci"))
+	conf = NewConfiguration()
+	assert.Nil(t, file.Decode(conf))
+	assert.Equal(t, &SecretValue{Command: []string{"pass", "show", "registry"}}, conf.RegistryInfo.Auth["password"])
+
+	// The map with the keys of the reference is merged out of the values of SecretValue.
+	writeConfigFiles(t, map[string]string{
+		"base.yml": `
+image:
+  label:
+    env: production
+    file: app.conf
+`,
+		"dbyml.yml": `
+extends: base.yml
+image:
+  label:
+    env: staging
+`,
+	})
+	file, err = ReadConfigFile("dbyml.yml", nil)
+	assert.Nil(t, err)
+	conf = NewConfiguration()
+	assert.Nil(t, file.Decode(conf))
+	assert.Equal(t, map[string]string{"env": "staging", "file": "app.conf"}, conf.ImageInfo.Labels)
+}
@@ -0,0 +1,311 @@
+package dbyml
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"golang.org/x/net/http2"
+)
+
+// The build secrets on build without buildkit builder are read by buildkit in docker daemon through
+// the session, which is gRPC over HTTP/2 on the connection hijacked from `POST /session` as the Docker CLI does.
+// Only the secrets and the health check services of buildkit are served, so the messages of protocol buffers
+// are encoded here instead of depending on buildkit and gRPC.
+const (
+	sessionSecretMethod = "/moby.buildkit.secrets.v1.Secrets/GetSecret"
+	sessionHealthMethod = "/grpc.health.v1.Health/Check"
+
+	// The ID of the JSON message in which docker daemon sends the status of buildkit
+	buildkitTraceID = "moby.buildkit.trace"
+)
+
+// sessionDialer hijacks the connection of the session from docker daemon.
+type sessionDialer func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error)
+
+// secretSession serves the values of the secrets to buildkit in docker daemon.
+type secretSession struct {
+	values map[string][]byte
+}
+
+// startSecretSession starts the session with docker daemon, through which the secrets are read on the build
+// without buildkit builder. The build is switched to buildkit in docker daemon by options, since the classic
+// builder of docker does not support secrets. The returned function closes the session after the build.
+func startSecretSession(ctx context.Context, dial sessionDialer, secrets []SecretSpec, options *types.ImageBuildOptions) (func(), error) {
+	session := &secretSession{values: map[string][]byte{}}
+	for _, secret := range secrets {
+		v, err := secret.Value()
+		if err != nil {
+			return nil, err
+		}
+		session.values[secret.ID] = v
+	}
+
+	id := newBuildID()
+	conn, err := dial(ctx, "h2c", map[string][]string{
+		"X-Docker-Expose-Session-Uuid":        {id},
+		"X-Docker-Expose-Session-Name":        {"dbyml"},
+		"X-Docker-Expose-Session-Sharedkey":   {""},
+		"X-Docker-Expose-Session-Grpc-Method": {sessionHealthMethod, sessionSecretMethod},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the session for secrets with docker daemon: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: session})
+	}()
+
+	options.SessionID = id
+	options.Version = types.BuilderBuildKit
+	return func() {
+		conn.Close()
+		<-done
+	}, nil
+}
+
+// ServeHTTP responds to the gRPC call of the method in the request.
+func (session *secretSession) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	switch r.URL.Path {
+	case sessionHealthMethod:
+		// HealthCheckResponse{status: SERVING}
+		writeGRPCMessage(w, appendProtoVarint(nil, 1, 1))
+	case sessionSecretMethod:
+		fields, err := decodeProto(req)
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		// GetSecretRequest{ID: 1}, GetSecretResponse{Data: 1}
+		id := string(protoBytes(fields, 1))
+		value, ok := session.values[id]
+		if !ok {
+			writeGRPCStatus(w, grpcNotFound, fmt.Sprintf("secret %v not found", id))
+			return
+		}
+		writeGRPCMessage(w, appendProtoBytes(nil, 1, value))
+	default:
+		writeGRPCStatus(w, grpcUnimplemented, fmt.Sprintf("method %v not implemented", r.URL.Path))
+	}
+}
+
+// The status codes of gRPC
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcNotFound        = 5
+	grpcUnimplemented   = 12
+)
+
+// readGRPCMessage reads a message prefixed with the compressed flag and the length.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("compressed message is not supported")
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, r)
+	return msg, nil
+}
+
+// writeGRPCMessage writes the message and the status OK in the trailer.
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	w.Write(append(prefix, msg...))
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcOK))
+}
+
+// writeGRPCStatus writes the error status in the header without the message.
+func writeGRPCStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+// protoField is a field of the message in the wire format of protocol buffers.
+type protoField struct {
+	Num    int
+	Varint uint64 // The value of varint and fixed types
+	Bytes  []byte // The value of string, bytes and embedded messages
+}
+
+// decodeProto splits the message in the wire format of protocol buffers into the fields.
+func decodeProto(b []byte) ([]protoField, error) {
+	fields := []protoField{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid protobuf message")
+		}
+		b = b[n:]
+		field := protoField{Num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			if field.Varint, n = binary.Uvarint(b); n <= 0 {
+				return nil, fmt.Errorf("invalid protobuf message")
+			}
+			b = b[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return nil, fmt.Errorf("invalid protobuf message")
+			}
+			b = b[size:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, fmt.Errorf("invalid protobuf message")
+			}
+			field.Bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			return nil, fmt.Errorf("invalid protobuf message")
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// protoBytes returns the last value of the field of num, which is the value of the field not repeated.
+func protoBytes(fields []protoField, num int) []byte {
+	var value []byte
+	for _, field := range fields {
+		if field.Num == num {
+			value = field.Bytes
+		}
+	}
+	return value
+}
+
+// protoTime returns the time of google.protobuf.Timestamp in the field of num, or nil if not set.
+func protoTime(fields []protoField, num int) (*time.Time, error) {
+	var ts []byte
+	found := false
+	for _, field := range fields {
+		if field.Num == num {
+			ts, found = field.Bytes, true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	tsFields, err := decodeProto(ts)
+	if err != nil {
+		return nil, err
+	}
+	var sec, nsec uint64
+	for _, field := range tsFields {
+		switch field.Num {
+		case 1:
+			sec = field.Varint
+		case 2:
+			nsec = field.Varint
+		}
+	}
+	t := time.Unix(int64(sec), int64(nsec))
+	return &t, nil
+}
+
+func appendProtoVarint(b []byte, num int, v uint64) []byte {
+	b = appendUvarint(b, uint64(num)<<3)
+	return appendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, num int, v []byte) []byte {
+	b = appendUvarint(b, uint64(num)<<3|2)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// decodeBuildkitTrace converts the StatusResponse of buildkit sent by docker daemon in the aux of
+// JSON message into solveStatus.
+func decodeBuildkitTrace(aux *json.RawMessage) (*solveStatus, error) {
+	var data []byte
+	if err := json.Unmarshal(*aux, &data); err != nil {
+		return nil, err
+	}
+	fields, err := decodeProto(data)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &solveStatus{}
+	for _, field := range fields {
+		switch field.Num {
+		case 1:
+			// Vertex{digest: 1, name: 3, cached: 4, started: 5, completed: 6, error: 7}
+			vf, err := decodeProto(field.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			v := solveVertex{
+				Digest: string(protoBytes(vf, 1)),
+				Name:   string(protoBytes(vf, 3)),
+				Error:  string(protoBytes(vf, 7)),
+			}
+			for _, f := range vf {
+				if f.Num == 4 {
+					v.Cached = f.Varint != 0
+				}
+			}
+			if v.Started, err = protoTime(vf, 5); err != nil {
+				return nil, err
+			}
+			if v.Completed, err = protoTime(vf, 6); err != nil {
+				return nil, err
+			}
+			status.Vertexes = append(status.Vertexes, v)
+		case 3:
+			// VertexLog{vertex: 1, timestamp: 2, stream: 3, msg: 4}
+			lf, err := decodeProto(field.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			l := solveLog{Vertex: string(protoBytes(lf, 1)), Data: protoBytes(lf, 4)}
+			for _, f := range lf {
+				if f.Num == 3 {
+					l.Stream = int(f.Varint)
+				}
+			}
+			ts, err := protoTime(lf, 2)
+			if err != nil {
+				return nil, err
+			}
+			if ts != nil {
+				l.Timestamp = *ts
+			}
+			status.Logs = append(status.Logs, l)
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,133 @@
+package dbyml
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+// callSession calls the gRPC method through the session as buildkit in docker daemon does,
+// and returns the response message and the status.
+func callSession(cc *http2.ClientConn, method string, req []byte) ([]byte, string, error) {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(req)))
+	httpReq, _ := http.NewRequest("POST", "http://session"+method, bytes.NewReader(append(prefix, req...)))
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("TE", "trailers")
+	res, err := cc.RoundTrip(httpReq)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) >= 5 {
+		body = body[5:]
+	}
+	// The error status is sent in the header without the message.
+	if status := res.Header.Get("Grpc-Status"); status != "" {
+		return nil, status, nil
+	}
+	return body, res.Trailer.Get("Grpc-Status"), nil
+}
+
+func TestSecretSession(t *testing.T) {
+	os.Setenv("DBYML_TEST_TOKEN", "env-token")
+	defer os.Unsetenv("DBYML_TEST_TOKEN")
+
+	var meta map[string][]string
+	server := make(chan net.Conn, 1)
+	dial := func(ctx context.Context, proto string, m map[string][]string) (net.Conn, error) {
+		meta = m
+		client, conn := net.Pipe()
+		server <- conn
+		return client, nil
+	}
+	options := types.ImageBuildOptions{}
+	secrets := []SecretSpec{{ID: "token", Env: "DBYML_TEST_TOKEN"}}
+	closeSession, err := startSecretSession(context.Background(), dial, secrets, &options)
+	assert.Nil(t, err)
+	defer closeSession()
+
+	// The build is switched to buildkit in docker daemon, which reads the secrets through the session.
+	assert.Equal(t, types.BuilderBuildKit, options.Version)
+	assert.Equal(t, []string{options.SessionID}, meta["X-Docker-Expose-Session-Uuid"])
+	assert.Equal(t, []string{sessionHealthMethod, sessionSecretMethod}, meta["X-Docker-Expose-Session-Grpc-Method"])
+
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(<-server)
+	assert.Nil(t, err)
+	resp, status, err := callSession(cc, sessionSecretMethod, appendProtoBytes(nil, 1, []byte("token")))
+	assert.Nil(t, err)
+	assert.Equal(t, "0", status)
+	assert.Equal(t, appendProtoBytes(nil, 1, []byte("env-token")), resp)
+
+	_, status, err = callSession(cc, sessionSecretMethod, appendProtoBytes(nil, 1, []byte("unknown")))
+	assert.Nil(t, err)
+	assert.Equal(t, "5", status)
+
+	resp, status, err = callSession(cc, sessionHealthMethod, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "0", status)
+	assert.Equal(t, []byte{0x08, 0x01}, resp)
+
+	// The secret which cannot be read fails before the session starts.
+	secrets = []SecretSpec{{ID: "token", Env: "DBYML_TEST_UNDEFINED"}}
+	_, err = startSecretSession(context.Background(), dial, secrets, &types.ImageBuildOptions{})
+	assert.EqualError(t, err, "failed to read secret token: ENV DBYML_TEST_UNDEFINED not defined")
+}
+
+// buildkitTrace returns the JSON message of buildkit trace which docker daemon sends for the vertex and the log.
+func buildkitTrace(digest string, name string, completed time.Time, log string) string {
+	timestamp := appendProtoVarint(appendProtoVarint(nil, 1, uint64(completed.Unix())), 2, uint64(completed.Nanosecond()))
+	vertex := appendProtoBytes(nil, 1, []byte(digest))
+	vertex = appendProtoBytes(vertex, 3, []byte(name))
+	vertex = appendProtoBytes(vertex, 5, timestamp)
+	vertex = appendProtoBytes(vertex, 6, timestamp)
+	vertexLog := appendProtoBytes(nil, 1, []byte(digest))
+	vertexLog = appendProtoBytes(vertexLog, 2, timestamp)
+	vertexLog = appendProtoVarint(vertexLog, 3, 1)
+	vertexLog = appendProtoBytes(vertexLog, 4, []byte(log))
+	status := appendProtoBytes(appendProtoBytes(nil, 1, vertex), 3, vertexLog)
+	aux, _ := json.Marshal(status)
+	return fmt.Sprintf(`{"id":%q,"aux":%s}`, buildkitTraceID, aux)
+}
+
+func TestDecodeBuildkitTrace(t *testing.T) {
+	completed := time.Date(2022, 6, 1, 12, 30, 45, 500, time.UTC)
+	var jm jsonmessage.JSONMessage
+	assert.Nil(t, json.Unmarshal([]byte(buildkitTrace("sha256:abc", "[1/1] RUN true", completed, "hello\n")), &jm))
+
+	status, err := decodeBuildkitTrace(jm.Aux)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(status.Vertexes))
+	assert.Equal(t, "sha256:abc", status.Vertexes[0].Digest)
+	assert.Equal(t, "[1/1] RUN true", status.Vertexes[0].Name)
+	assert.True(t, completed.Equal(*status.Vertexes[0].Completed))
+	assert.Equal(t, []solveLog{{Vertex: "sha256:abc", Stream: 1, Data: []byte("hello\n"), Timestamp: status.Logs[0].Timestamp}}, status.Logs)
+	assert.True(t, completed.Equal(status.Logs[0].Timestamp))
+
+	// The status is rendered like the plain output of buildctl.
+	var out bytes.Buffer
+	p, _ := NewProgress(ProgressPlain)
+	p.display = &out
+	p.solveStatus(status)
+	assert.Equal(t, "#1 [1/1] RUN true\n#1 DONE 0.0s\n#1 hello\n", out.String())
+
+	_, err = decodeProto([]byte{0x0a, 0x05, 0x01})
+	assert.EqualError(t, err, "invalid protobuf message")
+}
@@ -0,0 +1,97 @@
+package dbyml
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The directory in builder where the SSH agent sockets on host are mounted
+const builderSSHDir = "/run/dbyml/ssh"
+
+// SSHSpec defines an SSH agent socket or keys forwarded to `RUN --mount=type=ssh` in Dockerfile.
+// It is written as `default` to forward the agent of SSH_AUTH_SOCK, or `id=path` where path is
+// an agent socket or a private key on host.
+type SSHSpec struct {
+	ID   string
+	Path string
+}
+
+// ParseSSHSpec parses the value in the form of `default` or `id=path`.
+func ParseSSHSpec(value string) (SSHSpec, error) {
+	arr := strings.SplitN(value, "=", 2)
+	spec := SSHSpec{ID: arr[0]}
+	if len(arr) == 2 {
+		spec.Path = arr[1]
+		if spec.Path == "" {
+			return spec, fmt.Errorf("ssh %v requires path", spec.ID)
+		}
+	}
+	if !secretIDPattern.MatchString(spec.ID) || spec.ID == "." || spec.ID == ".." {
+		return spec, fmt.Errorf("ssh id %q must consist of alphanumerics, '.', '_' and '-'", spec.ID)
+	}
+	if spec.Path == "" && spec.ID != "default" {
+		return spec, fmt.Errorf("ssh %v requires path such as %v=~/.ssh/id_rsa", spec.ID, spec.ID)
+	}
+	return spec, nil
+}
+
+// UnmarshalYAML decodes the value in the form of `default` or `id=path`.
+func (spec *SSHSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	parsed, err := ParseSSHSpec(value)
+	if err != nil {
+		return err
+	}
+	*spec = parsed
+	return nil
+}
+
+// String returns the value in the form of `default` or `id=path`.
+func (spec SSHSpec) String() string {
+	if spec.Path == "" {
+		return spec.ID
+	}
+	return spec.ID + "=" + spec.Path
+}
+
+// HostPath returns the path on host forwarded into builder.
+// It is the socket of SSH_AUTH_SOCK if the path is not set.
+func (spec *SSHSpec) HostPath() (string, error) {
+	if spec.Path != "" {
+		return expandHome(spec.Path)
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return "", fmt.Errorf("ssh %v requires SSH_AUTH_SOCK, start ssh-agent or set path to the key", spec.ID)
+	}
+	return sock, nil
+}
+
+// IsSocket returns true if the path on host is an SSH agent socket, otherwise it is treated as a private key.
+func (spec *SSHSpec) IsSocket() (bool, error) {
+	path, err := spec.HostPath()
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("ssh %v: %v", spec.ID, err)
+	}
+	return info.Mode()&os.ModeSocket != 0, nil
+}
+
+// expandHome replaces the leading `~` of path with the home directory.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return home + path[1:], nil
+}
@@ -0,0 +1,94 @@
+package dbyml
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseSSHSpec(t *testing.T) {
+	tests := []struct {
+		value string
+		spec  SSHSpec
+		valid bool
+	}{
+		{"default", SSHSpec{ID: "default"}, true},
+		{"default=/tmp/agent.sock", SSHSpec{ID: "default", Path: "/tmp/agent.sock"}, true},
+		{"github=~/.ssh/id_ed25519", SSHSpec{ID: "github", Path: "~/.ssh/id_ed25519"}, true},
+		{"github", SSHSpec{}, false},
+		{"github=", SSHSpec{}, false},
+		{"../key=/tmp/key", SSHSpec{}, false},
+	}
+	for _, tt := range tests {
+		spec, err := ParseSSHSpec(tt.value)
+		assert.Equal(t, tt.valid, err == nil, "%v: %v", tt.value, err)
+		if tt.valid {
+			assert.Equal(t, tt.spec, spec)
+			assert.Equal(t, tt.value, spec.String())
+		}
+	}
+
+	var image ImageInfo
+	err := yaml.Unmarshal([]byte("ssh: [default, github=/tmp/key]"), &image)
+	assert.Nil(t, err)
+	assert.Equal(t, []SSHSpec{{ID: "default"}, {ID: "github", Path: "/tmp/key"}}, image.SSH)
+	err = yaml.Unmarshal([]byte("ssh: [github]"), &image)
+	assert.Error(t, err)
+}
+
+func TestSSHForward(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	key := filepath.Join(dir, "id_ed25519")
+	ioutil.WriteFile(key, []byte("private key"), 0o600)
+
+	os.Setenv("SSH_AUTH_SOCK", sock)
+	defer os.Unsetenv("SSH_AUTH_SOCK")
+
+	agent := SSHSpec{ID: "default"}
+	path, err := agent.HostPath()
+	assert.Nil(t, err)
+	assert.Equal(t, sock, path)
+	socket, err := agent.IsSocket()
+	assert.Nil(t, err)
+	assert.True(t, socket)
+
+	keyfile := SSHSpec{ID: "github", Path: key}
+	socket, err = keyfile.IsSocket()
+	assert.Nil(t, err)
+	assert.False(t, socket)
+
+	builder := NewBuilder()
+	err = builder.MountSSHAgents([]SSHSpec{agent, keyfile}, "unix:///var/run/docker.sock")
+	assert.Nil(t, err)
+	assert.Equal(t, []mount.Mount{{Type: mount.TypeBind, Source: sock, Target: "/run/dbyml/ssh/default.sock"}}, builder.HostConfig.Mounts)
+	assert.Equal(t, []string{"--ssh", "default=/run/dbyml/ssh/default.sock"}, builder.Cmd[len(builder.Cmd)-2:])
+
+	// The agent is not forwarded to the daemon on another host, where the socket does not exist.
+	for _, host := range []string{"ssh://user@build-host", "tcp://192.168.1.10:2376"} {
+		builder = NewBuilder()
+		err = builder.MountSSHAgents([]SSHSpec{agent, keyfile}, host)
+		assert.EqualError(t, err, fmt.Sprintf(
+			"ssh default: the agent socket %v cannot be forwarded to the docker daemon %v on another host, set a private key instead", sock, host,
+		))
+		assert.Empty(t, builder.HostConfig.Mounts)
+	}
+	// The key file is copied into the builder on any daemon.
+	assert.Nil(t, NewBuilder().MountSSHAgents([]SSHSpec{keyfile}, "ssh://user@build-host"))
+
+	os.Unsetenv("SSH_AUTH_SOCK")
+	_, err = agent.HostPath()
+	assert.Error(t, err)
+}
@@ -0,0 +1,189 @@
+package dbyml
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The host of the Docker API requests sent through SSH, which is not used to connect.
+const sshDummyHost = "http://docker.example.com"
+
+// IsSSHHost returns true if the docker host is a remote daemon reached through SSH such as `ssh://user@host`.
+func IsSSHHost(host string) bool {
+	return strings.HasPrefix(host, "ssh://")
+}
+
+// sshArgs returns the arguments of the ssh binary to run `docker system dial-stdio` on the remote host
+// of `ssh://[user@]host[:port]`, as the Docker CLI does.
+func sshArgs(host string) ([]string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %v: %v", host, err)
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid docker host %v: must be ssh://[user@]host[:port]", host)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("invalid docker host %v: path %v is not supported", host, u.Path)
+	}
+	args := []string{}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return nil, fmt.Errorf("invalid docker host %v: password is not supported, use ssh-agent or a key", host)
+		}
+		args = append(args, "-l", u.User.Username())
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	return append(args, "--", u.Hostname(), "docker", "system", "dial-stdio"), nil
+}
+
+// sshDialer returns the dialer connecting to the docker daemon on the remote host through the system ssh binary.
+// The authentication is done by ssh, such as with SSH agent or the keys and hosts in ~/.ssh/config.
+func sshDialer(host string) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	args, err := sshArgs(host)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialCommand(ctx, "ssh", args...)
+	}, nil
+}
+
+// dialCommand runs the command and returns the connection over its stdin and stdout.
+// The command is not killed by ctx, which is used only for connecting, but when the connection is closed.
+func dialCommand(ctx context.Context, name string, args ...string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Env = os.Environ()
+	// The command is not interrupted by Ctrl-C on terminal, so that the builder is cleaned up through it.
+	detachProcessGroup(cmd)
+
+	conn := &commandConn{cmd: cmd, name: name}
+	var err error
+	if conn.stdin, err = cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if conn.stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	cmd.Stderr = &conn.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run %v: %v", name, err)
+	}
+	return conn, nil
+}
+
+// commandConn is a net.Conn over stdin and stdout of a command.
+type commandConn struct {
+	cmd    *exec.Cmd
+	name   string
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr lockedBuffer
+
+	closeOnce sync.Once
+	waitOnce  sync.Once
+	waitErr   error
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		// The end of output is an error only if the command fails, since ssh writes warnings
+		// such as `Permanently added ... to the list of known hosts` to stderr on success.
+		if waitErr := c.wait(); waitErr != nil {
+			if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+				return n, fmt.Errorf("%v: %v", c.name, msg)
+			}
+			return n, fmt.Errorf("%v: %v", c.name, waitErr)
+		}
+	}
+	return n, err
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// CloseWrite closes stdin of the command, which is called on the end of input of hijacked connections.
+func (c *commandConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+// Close closes the connection and kills the command.
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		c.wait()
+	})
+	return nil
+}
+
+// wait waits until the command exits and all of its stderr is copied, and returns the error of the exit.
+func (c *commandConn) wait() error {
+	c.waitOnce.Do(func() { c.waitErr = c.cmd.Wait() })
+	return c.waitErr
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return commandAddr(c.name)
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return commandAddr(c.name)
+}
+
+func (c *commandConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *commandConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *commandConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// commandAddr is the address of commandConn, which is the name of the command.
+type commandAddr string
+
+func (a commandAddr) Network() string {
+	return "command"
+}
+
+func (a commandAddr) String() string {
+	return string(a)
+}
+
+// lockedBuffer is a buffer safe for writing by the command and reading by the connection at the same time.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package dbyml
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detachProcessGroup runs the command in a new process group not to receive the signals sent to dbyml on terminal.
+func detachProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,6 @@
+package dbyml
+
+import "os/exec"
+
+// detachProcessGroup does nothing on Windows, where Ctrl-C is not sent to the child processes by process group.
+func detachProcessGroup(cmd *exec.Cmd) {}
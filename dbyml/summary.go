@@ -0,0 +1,176 @@
+package dbyml
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	units "github.com/docker/go-units"
+)
+
+// Uncached steps taking longer than this are highlighted in the summary by default
+const defaultSlowStep = 10 * time.Second
+
+// The maximum length of the step name shown in the summary
+const summaryNameWidth = 60
+
+// The vertex of buildkit corresponding to a Dockerfile step, such as `[2/3] RUN make` or `[builder 1/4] FROM golang`
+var buildkitStepPattern = regexp.MustCompile(`^\[[^\]]*\d+/\d+\] `)
+
+// The shell form of RUN in the image history made by buildkit, such as `RUN |1 VERSION=1.0 /bin/sh -c make`
+var buildkitRunPattern = regexp.MustCompile(`^RUN (\|\d+ (\S+=\S* )*)?/bin/sh -c `)
+
+// The comment of the image history made by the Dockerfile instruction on buildkit
+const buildkitHistoryComment = "buildkit.dockerfile.v0"
+
+// StepSummary is the result of a Dockerfile step shown in the summary.
+type StepSummary struct {
+	Name     string
+	Duration time.Duration
+	Cached   bool
+	Size     int64 // Size of the layer made by the step, or -1 if unknown
+	Slow     bool  // Whether the step is uncached and slower than the threshold
+}
+
+// Steps returns the results of the Dockerfile steps in order of start.
+// The internal vertexes of buildkit, such as loading the build definition or exporting the image, are excluded.
+func (p *Progress) Steps() []StepSummary {
+	summaries := []StepSummary{}
+	for _, id := range p.order {
+		step := p.steps[id]
+		if p.Builder == "buildkit" && !buildkitStepPattern.MatchString(step.Name) {
+			continue
+		}
+		summaries = append(summaries, StepSummary{
+			Name:     step.Name,
+			Duration: step.Duration,
+			Cached:   step.Cached,
+			Size:     step.Size,
+			Slow:     !step.Cached && p.SlowStep > 0 && step.Duration >= p.SlowStep,
+		})
+	}
+	return summaries
+}
+
+// SetLayerSizes sets the size of the layer made by each step of the build without buildkit from the image history.
+func (p *Progress) SetLayerSizes(history []image.HistoryResponseItem) {
+	for _, step := range p.steps {
+		if step.Layer == "" {
+			continue
+		}
+		for _, item := range history {
+			if strings.HasPrefix(strings.TrimPrefix(item.ID, "sha256:"), step.Layer) {
+				step.Size = item.Size
+				break
+			}
+		}
+	}
+}
+
+// SetBuildkitLayerSizes sets the size of the layer made by each step of the build with buildkit from the history
+// of the image loaded into docker daemon. The history made by the instructions is matched with the steps by the
+// instruction from the last, so that the steps of the final stage are matched rather than the other stages.
+func (p *Progress) SetBuildkitLayerSizes(history []image.HistoryResponseItem) {
+	ids := []string{}
+	for _, id := range p.order {
+		if buildkitStepPattern.MatchString(p.steps[id].Name) {
+			ids = append(ids, id)
+		}
+	}
+	last := len(ids) - 1
+	for _, item := range history {
+		if item.Comment != buildkitHistoryComment {
+			continue
+		}
+		instruction := stepInstruction(item.CreatedBy)
+		for i := last; i >= 0; i-- {
+			if stepInstruction(p.steps[ids[i]].Name) == instruction {
+				p.steps[ids[i]].Size = item.Size
+				last = i - 1
+				break
+			}
+		}
+	}
+}
+
+// stepInstruction returns the instruction of the step or the image history without the stage, the flags such as
+// --mount, the shell of RUN and the comment of buildkit, which is the same between the vertex and the history.
+func stepInstruction(name string) string {
+	name = buildkitStepPattern.ReplaceAllString(name, "")
+	name = strings.TrimSuffix(name, " # buildkit")
+	name = buildkitRunPattern.ReplaceAllString(name, "RUN ")
+	fields := strings.Fields(name)
+	if len(fields) == 0 {
+		return ""
+	}
+	args := fields[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		args = args[1:]
+	}
+	return strings.Join(append([]string{fields[0]}, args...), " ")
+}
+
+// ShowSummary shows the table of the Dockerfile steps with duration, cache hit and size of layer,
+// where the slow uncached steps are highlighted. It is shown only in tty and plain mode.
+func (p *Progress) ShowSummary() {
+	if !p.Summary || (p.Mode != ProgressTTY && p.Mode != ProgressPlain) {
+		return
+	}
+	steps := p.Steps()
+	if len(steps) == 0 {
+		return
+	}
+
+	var total time.Duration
+	cached := 0
+	sized := false
+	width := len("STEP")
+	for _, step := range steps {
+		total += step.Duration
+		if step.Cached {
+			cached++
+		}
+		sized = sized || step.Size >= 0
+		if n := len(summaryName(step.Name)); n > width {
+			width = n
+		}
+	}
+
+	// The size is known only for the image loaded into docker daemon.
+	note := ""
+	if p.Builder == "buildkit" && !sized {
+		note = "; size is shown only for the output type docker"
+	}
+	fmt.Printf("Step summary (%d steps, %d cached, %.1fs in total%s)\n", len(steps), cached, total.Seconds(), note)
+	fmt.Printf("%-*s  %9s  %-5s  %9s\n", width, "STEP", "DURATION", "CACHE", "SIZE")
+	for _, step := range steps {
+		cache := "miss"
+		if step.Cached {
+			cache = "hit"
+		}
+		size := "-"
+		if step.Size >= 0 {
+			size = units.HumanSize(float64(step.Size))
+		}
+		line := fmt.Sprintf("%-*s  %8.1fs  %-5s  %9s", width, summaryName(step.Name), step.Duration.Seconds(), cache, size)
+		if step.Slow {
+			line += "  <- slow"
+			if p.Mode == ProgressTTY {
+				line = "\x1b[33m" + line + "\x1b[0m"
+			}
+		}
+		fmt.Println(line)
+	}
+	fmt.Println()
+}
+
+// summaryName shortens the step name to fit in the summary.
+func summaryName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if len(name) > summaryNameWidth {
+		return name[:summaryNameWidth-3] + "..."
+	}
+	return name
+}
@@ -0,0 +1,113 @@
+package dbyml
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSteps(t *testing.T) {
+	p, _ := NewProgress(ProgressPlain)
+	p.Builder = "buildkit"
+	p.SlowStep = 3 * time.Second
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		id       string
+		name     string
+		duration time.Duration
+		cached   bool
+	}{
+		{"a", "[internal] load build definition from Dockerfile", time.Second, false},
+		{"b", "[builder 1/2] FROM docker.io/library/golang:1.18", 2 * time.Second, true},
+		{"c", "[builder 2/2] RUN go build", 20 * time.Second, false},
+		{"d", "[stage-1 1/1] COPY --from=builder /app /app", time.Second, false},
+		{"e", "[builder 2/2] RUN go test", 20 * time.Second, true},
+		{"f", "exporting to image", time.Second, false},
+	}
+	for _, s := range steps {
+		p.stepStart(s.id, s.name, start)
+		p.stepFinish(s.id, start.Add(s.duration), s.cached, "")
+	}
+
+	summaries := p.Steps()
+	assert.Equal(t, 4, len(summaries))
+	assert.Equal(t, "[builder 1/2] FROM docker.io/library/golang:1.18", summaries[0].Name)
+	assert.Equal(t, []bool{false, true, false, false}, []bool{
+		summaries[0].Slow, summaries[1].Slow, summaries[2].Slow, summaries[3].Slow,
+	})
+	assert.Equal(t, int64(-1), summaries[1].Size)
+
+	stdout := extractStdout(t, p.ShowSummary)
+	lines := strings.Split(stdout, "\n")
+	assert.Equal(t, "Step summary (4 steps, 2 cached, 43.0s in total; size is shown only for the output type docker)", lines[0])
+	assert.Contains(t, lines[3], "[builder 2/2] RUN go build")
+	assert.Contains(t, lines[3], "20.0s  miss")
+	assert.True(t, strings.HasSuffix(lines[3], "<- slow"))
+	assert.False(t, strings.HasSuffix(lines[5], "<- slow"))
+
+	p.Mode = ProgressJSON
+	assert.Equal(t, "", extractStdout(t, p.ShowSummary))
+}
+
+func TestSetLayerSizes(t *testing.T) {
+	p, _ := NewProgress(ProgressPlain)
+	for _, line := range []string{
+		"Step 1/2 : FROM alpine:3.16",
+		" ---> 9c6f07244728",
+		"Step 2/2 : RUN apk add curl",
+		" ---> Running in 1f2e3d4c5b6a",
+		" ---> 0d3c3f7b2b1a",
+	} {
+		p.classicLine(line)
+	}
+	p.finishClassicStep("")
+	p.SetLayerSizes([]image.HistoryResponseItem{
+		{ID: "sha256:0d3c3f7b2b1a0000", Size: 2048},
+		{ID: "sha256:9c6f072447280000", Size: 5600000},
+	})
+
+	summaries := p.Steps()
+	assert.Equal(t, int64(5600000), summaries[0].Size)
+	assert.Equal(t, int64(2048), summaries[1].Size)
+	assert.Equal(t, "RUN apk add curl", summaries[1].Name)
+}
+
+func TestSetBuildkitLayerSizes(t *testing.T) {
+	p, _ := NewProgress(ProgressPlain)
+	p.Builder = "buildkit"
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{
+		"[builder 1/2] FROM docker.io/library/golang:1.18",
+		"[builder 2/2] COPY . .",
+		"[stage-1 1/4] FROM docker.io/library/alpine:3.16",
+		"[stage-1 2/4] COPY . .",
+		"[stage-1 3/4] RUN --mount=type=secret,id=token make",
+		"[stage-1 4/4] COPY --from=builder /app /app",
+		"exporting to image",
+	} {
+		id := fmt.Sprintf("sha256:%d", i)
+		p.stepStart(id, name, start)
+		p.stepFinish(id, start.Add(time.Second), false, "")
+	}
+	// The history of the image is in order from the newest.
+	p.SetBuildkitLayerSizes([]image.HistoryResponseItem{
+		{CreatedBy: "COPY /app /app # buildkit", Comment: buildkitHistoryComment, Size: 4096},
+		{CreatedBy: "RUN |1 VERSION=1.0 /bin/sh -c make # buildkit", Comment: buildkitHistoryComment, Size: 2048},
+		{CreatedBy: "ENV VERSION=1.0", Comment: buildkitHistoryComment},
+		{CreatedBy: "COPY . . # buildkit", Comment: buildkitHistoryComment, Size: 1024},
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:abc in / ", Size: 5600000},
+	})
+
+	sizes := []int64{}
+	for _, step := range p.Steps() {
+		sizes = append(sizes, step.Size)
+	}
+	assert.Equal(t, []int64{-1, -1, -1, 1024, 2048, 4096}, sizes)
+
+	stdout := extractStdout(t, p.ShowSummary)
+	assert.Equal(t, "Step summary (6 steps, 0 cached, 6.0s in total)", strings.Split(stdout, "\n")[0])
+}
@@ -14,6 +14,19 @@ const ConfigurationTemplate = `---
 # The values set in each field, so you can edit them according to your build settings.
 # This is automatically generated.
 
+# env_file: List of the dotenv files whose variables are used in this file, relative to this file.
+# The files not found are skipped, and the environment variables take precedence over them.
+# env_file:
+#   - .env
+#   - .env.local
+
+# extends: Path to the base config file whose settings are inherited.
+# include: List of paths to the config files merged after the base file.
+# Run dbyml config show --origin to see the merged settings.
+# extends: ../base/dbyml.yml
+# include:
+#   - ../shared/labels.yml
+
 
 # The image section manages docker image attributes.
 image:
@@ -23,14 +36,44 @@ image:
   # tag: Image tag.
   tag: {{ or .ImageInfo.Tag "latest" }}
 
-  # path: Path to a directory containing Dockerfile.
+  # path: Path to the build context directory.
+  # A URL to a Git repository such as git@github.com:org/repo.git#ref:subdir, https://github.com/org/repo.git#tag,
+  # or a tarball such as https://example.com/context.tar.gz can be set to build from the remote context.
   path: {{ or .ImageInfo.Context "." }}
 
-  # dockerfile: Filename of Dockerfile.
+  # dockerfile: Path to Dockerfile.
+  # The path is looked up in the build context first, then relative to the current directory,
+  # so the Dockerfile may be outside the build context. Set - to read the Dockerfile from stdin.
   dockerfile: {{ or .ImageInfo.Dockerfile "Dockerfile" }}
 
+  # dockerfile_inline: Content of Dockerfile used instead of the dockerfile field.
+  # dockerfile_inline: |
+  #   FROM alpine:latest
+  #   CMD ["echo", "hello"]
+
+  # contexts: Named additional build contexts used by buildkit, which are referred as "FROM name" or "COPY --from=name" in Dockerfile.
+  # Set a local directory, or a reference such as docker-image://alpine:3.16.
+  # contexts:
+  #   shared: ../shared
+  #   base: docker-image://alpine:3.16
+
+  # secrets: Build secrets mounted by "RUN --mount=type=secret,id=..." in Dockerfile.
+  # The build without buildkit is switched to the buildkit in docker daemon when secrets are set.
+  # Set id and either src (file on host) or env (environment variable on host).
+  # secrets:
+  #   - id: npmrc
+  #     src: ${HOME}/.npmrc
+  #   - id: token
+  #     env: GITHUB_TOKEN
+
+  # ssh: SSH agent sockets or private keys forwarded to buildkit, which are used by "RUN --mount=type=ssh" in Dockerfile.
+  # Set "default" to forward the agent of SSH_AUTH_SOCK, or "id=path" to forward an agent socket or a private key.
+  # ssh:
+  #   - default
+  #   - github=~/.ssh/id_ed25519
+
   # build_args: Arguments corresponding to build-args of docker build.
-  # Set list of key:value
+  # Set list of key:value. The value can be read from {file: path}, {env: VAR} or {command: [cmd, args...]}.
   build_args:
     {{- range $k, $v := .ImageInfo.BuildArgs }}
     {{ $k }}: {{ $v }}
@@ -45,9 +88,18 @@ image:
     {{- end }}
 
   # docker_host: URL to the Docker server.
-  # Set protocol:hostname:port for example unix:///var/run/docker.sock or tcp://127.0.0.1:1234.
-  # Default to unix:///var/run/docker.sock
-  docker_host: {{ or .ImageInfo.DockerHost "unix:/var/run/docker.sock" }}
+  # Set protocol:hostname:port for example unix:///var/run/docker.sock, tcp://127.0.0.1:1234 or ssh://user@host.
+  # If empty, DOCKER_HOST, the current Docker CLI context and unix:///var/run/docker.sock are used in this order.
+  # The same docker host is used for build, push and the buildkit builder.
+  docker_host: {{ or .ImageInfo.DockerHost "''" }}
+
+  # tls_verify: Set true to connect to the docker host with TLS and verify its certificate.
+  # default: false, or true if DOCKER_TLS_VERIFY is set
+  tls_verify: {{ or .ImageInfo.TLSVerify false }}
+
+  # cert_path: Directory containing ca.pem, cert.pem and key.pem for TLS.
+  # default: DOCKER_CERT_PATH, or ~/.docker if tls_verify is true
+  cert_path: {{ or .ImageInfo.CertPath "''" }}
 
 
 # The build section manages some options on build such as using build-cache or showing build information.
@@ -63,6 +115,60 @@ build:
   # default: true
   verbose: {{ or .BuildInfo.Verbose true }}
 
+  # max_context_size: Upper limit of the build context size such as 500MB.
+  # The build is aborted before the context is sent if it exceeds the limit.
+  # default: no limit
+  max_context_size: {{ or .BuildInfo.MaxContextSize "''" }}
+
+  # context_top: The number of the largest files and directories shown when the context exceeds max_context_size.
+  # default: 10
+  context_top: {{ or .BuildInfo.ContextTop 10 }}
+
+  # compress: Set true to compress the build context with gzip before sending it to the docker daemon or the buildkit builder.
+  # This is useful when docker_host is a remote daemon over a slow link.
+  # default: false
+  compress: {{ or .BuildInfo.Compress false }}
+
+  # cache_from: Images used as cache sources on build without buildkit.
+  # The images must be pulled or built on the docker host in advance.
+  cache_from:
+    {{- range .BuildInfo.CacheFrom }}
+    - {{ . }}
+    {{- end }}
+
+  # progress: Progress output mode, one of auto, tty, plain, json or quiet.
+  # json writes the events of build to stdout one per line. The --progress option overrides this.
+  # default: auto
+  progress: {{ or .BuildInfo.Progress "auto" }}
+
+  # summary: Set true to show the summary of the Dockerfile steps with duration, cache hit and size of layer after build.
+  # default: true
+  summary: {{ .BuildInfo.Summary }}
+
+  # slow_step: Uncached steps taking longer than this are highlighted in the summary.
+  # default: 10s
+  slow_step: {{ or .BuildInfo.SlowStep "10s" }}
+
+  # log_file: Template of the log file into which the output of build and push is copied without colors.
+  # {{ "{{.Image}}" }}, {{ "{{.Tag}}" }} and {{ "{{.Date}}" }} are replaced with the image name, tag and the date of build.
+  # log_file: logs/build-{{ "{{.Image}}-{{.Date}}" }}.log
+  log_file: {{ or .BuildInfo.LogFile "''" }}
+
+  # log_keep: The number of the log files kept for each image. The older files are removed. No rotation if 0.
+  # default: 10
+  log_keep: {{ .BuildInfo.LogKeep }}
+
+  # timeout: Upper limit of the time of build such as 30m. The build fails if it does not finish in time.
+  # With buildkit, this includes the push of the image. The --build-timeout option overrides this.
+  # default: no limit
+  timeout: {{ or .BuildInfo.Timeout "''" }}
+
+# The push section defines the options on push to the registry.
+push:
+  # timeout: Upper limit of the time of push such as 10m. The --push-timeout option overrides this.
+  # default: no limit
+  timeout: {{ or .PushInfo.Timeout "''" }}
+
 # The registry section manages the information about registry to which the image push.
 registry:
   # enabled: Enable push to a registry. Set false not to push the image
@@ -78,6 +184,8 @@ registry:
   project: {{ or .RegistryInfo.Project "" }}
 
   # auth: Credentials for a registry. This will be used when push a image to basic-auth registry.
+  # The values can be read from {file: path}, {env: VAR} or {command: [cmd, args...]} such as
+  # password: {file: /run/secrets/regpass}
   auth:
     {{- range $k, $v := .RegistryInfo.Auth }}
     {{ $k }}: {{ $v }}
@@ -90,28 +198,59 @@ buildkit:
   # output: The output field sets output format of the image to be built
   output:
     # type: Type of output image.
+    # Set image or registry to push the image to the registry, docker to load the image into the docker daemon,
+    # oci or tar to save the image as a tarball in dest, local to export the filesystem of the image into the directory dest.
     type: {{ or .BuildkitInfo.Output.Type "image" }}
     # name: Set registry and image. e.g. [registry]:[port]/[project]/[image]:[tag]
     name: {{ or .BuildkitInfo.Output.Name "myregistry.com/go-dbyml-sample:latest" }}
     # insecure: Set true if push the image insecure registry such as insecure private registry
     insecure: {{ or .BuildkitInfo.Output.Insecure false }}
+    # dest: Path on host where the image is saved when type is oci, tar or local.
+    # dest: ./image.tar
   # The cache field sets import and export build cache.
   cache:
     # export: Export settings of build cache.
-    # Type must be either inline or registry. Set inline to export the cache embed with the image and pushing them to registry together.
+    # Type must be either inline, registry or local. Set inline to export the cache embed with the image and pushing them to registry together.
     # Set registry to export build cache to the specified registry. In this case, set the registry in value field. e.g. [registry]:[port]/[project]/[image]:[tag]
+    # mode, compression, compression_level, force_compression, oci_mediatypes and ignore_error can also be set
+    # when type is registry or local. e.g. mode: max
     export:
       type: {{ or .BuildkitInfo.Cache.Export.Type "inline" }}
       value: {{ or .BuildkitInfo.Cache.Export.Value "''" }}
     # import: Import settings of build cache.
-    # Type must be registry. Set registry to import build cache from the specified registry. In this case, set the registry in value field. e.g. [registry]:[port]/[project]/[image]:[tag].
+    # Type must be registry or local. Set registry to import build cache from the specified registry. In this case, set the registry in value field. e.g. [registry]:[port]/[project]/[image]:[tag].
+    # Set local to import build cache from the directory on host in src field, and export it to the directory in dest field of export.
+    # Set the list of sources to import build cache from multiple sources. Buildkit tries the sources in order.
     import:
-      type: {{ or .BuildkitInfo.Cache.Import.Type "registry" }}
-      value: {{ or .BuildkitInfo.Cache.Import.Value "myregistry.com/go-dbyml-sample:latest" }}
+      {{- range .BuildkitInfo.Cache.Import }}
+      - type: {{ .Type }}
+        value: {{ .Value }}
+      {{- else }}
+      - type: registry
+        value: myregistry.com/go-dbyml-sample:latest
+      {{- end }}
   # platform: Set the list of architectures if want to build  a image that support multi-platform.
   platform:
-  # remove: Set true to remove a builder container after build is successfully completed.
+  # remove: Set true to remove a builder container after build, otherwise the builder is stopped.
   remove: {{ or .BuildkitInfo.Remove true }}
+
+  # startup_timeout: Upper limit of the time until the builder container is ready for build.
+  # The --startup-timeout option overrides this.
+  # default: 2m
+  startup_timeout: {{ or .BuildkitInfo.StartupTimeout "2m" }}
+
+# The profiles section defines the overlays of the settings selected by --profile or DBYML_PROFILE.
+# The settings of the selected profile are merged on the settings above.
+# profiles:
+#   dev:
+#     build:
+#       no_cache: false
+#     registry:
+#       enabled: false
+#   prod:
+#     image:
+#       label:
+#         release: "true"
 `
 
 // MakeTemplate makes a dbyml setting file from a template.
@@ -131,8 +270,8 @@ const BuildkitdTomlTemplate = `[registry."{{ .Host }}"]
   {{- if .Insecure }}
   insecure = true
   {{- end }}
-  {{- if .Auth.ca_cert }}
-  ca_cert = ["{{ .Auth.ca_cert }}"]
+  {{- with .AuthValue "ca_cert" }}
+  ca_cert = ["{{ . }}"]
   {{- end }}
 `
 